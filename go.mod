@@ -6,6 +6,7 @@ require (
 	github.com/frankban/quicktest v1.11.3 // indirect
 	github.com/golang/protobuf v1.4.2
 	github.com/google/uuid v1.2.0
+	github.com/klauspost/compress v1.11.13
 	github.com/ks3sdklib/aws-sdk-go v1.0.7
 	github.com/pierrec/lz4 v2.5.2+incompatible
 	github.com/stretchr/testify v1.6.1
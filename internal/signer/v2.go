@@ -32,6 +32,9 @@ type signer struct {
 	authorization     string
 }
 
+// SignHandlerName is the name Sign is registered under in the Sign handlers.
+const SignHandlerName = "v2.Sign"
+
 func Sign(req *service.Request) {
 	if req.Service.Config.Credentials == credentials.AnonymousCredentials {
 		return
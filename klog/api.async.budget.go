@@ -0,0 +1,105 @@
+package klog
+
+import (
+	"context"
+	"fmt"
+	"github.com/ks3sdk/klog-go-sdk/internal/apierr"
+	"sync"
+)
+
+// budget限制已推入但尚未处理完的日志的总字节数，字节数按proto.Size计算。
+// nil表示不限制。
+type budget struct {
+	max int64
+
+	mu    sync.Mutex
+	used  int64
+	freed chan struct{}
+}
+
+func newBudget(max int64) *budget {
+	if max <= 0 {
+		return nil
+	}
+	return &budget{max: max, freed: make(chan struct{})}
+}
+
+// tryAcquire占用n字节，超出上限时返回false和一个在有字节被释放时关闭的channel。
+// 预算未被占用时，超过上限的单条日志也可以占用，以免永远无法推入。
+func (b *budget) tryAcquire(n int64) (bool, <-chan struct{}) {
+	if b == nil {
+		return true, nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used > 0 && b.used+n > b.max {
+		return false, b.freed
+	}
+	b.used += n
+	return true, nil
+}
+
+func (b *budget) release(n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	b.used -= n
+	close(b.freed)
+	b.freed = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// reserve按policy为ev占用日志池和所有日志池共用的字节预算，未能占用时返回错误。
+func (o *AsyncClient) reserve(ctx context.Context, ev *event, policy OverflowPolicy) error {
+	if o.budget == nil && o.sharedBudget == nil {
+		return nil
+	}
+	n := int64(ev.size)
+	for {
+		ok, freed := o.budget.tryAcquire(n)
+		exceeded := o.budget
+		if ok {
+			if ok, freed = o.sharedBudget.tryAcquire(n); ok {
+				ev.reserved = n
+				return nil
+			}
+			o.budget.release(n)
+			exceeded = o.sharedBudget
+		}
+
+		switch policy {
+		case OverflowDropNewest:
+			return errBudgetExceeded(exceeded.max, nil)
+		case OverflowDropOldest:
+			// 丢弃本日志池发送队列中最早的日志，释放其占用的字节
+			select {
+			case old := <-o.ch:
+				o.refuse(old, errQueueOverflow(nil))
+			case <-o.closing:
+				return errClientClosed()
+			default:
+				return errBudgetExceeded(exceeded.max, nil)
+			}
+		default:
+			select {
+			case <-freed:
+			case <-o.closing:
+				return errClientClosed()
+			case <-ctx.Done():
+				return errBudgetExceeded(exceeded.max, ctx.Err())
+			}
+		}
+	}
+}
+
+// unreserve释放ev占用的字节预算。
+func (o *AsyncClient) unreserve(ev *event) {
+	o.budget.release(ev.reserved)
+	o.sharedBudget.release(ev.reserved)
+	ev.reserved = 0
+}
+
+func errBudgetExceeded(max int64, cause error) error {
+	return apierr.New(QueueOverflow, fmt.Sprintf("the buffered logs exceed the budget of %d bytes, log dropped", max), cause)
+}
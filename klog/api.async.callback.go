@@ -0,0 +1,46 @@
+package klog
+
+import (
+	"sync"
+)
+
+// callbackQueue按顺序逐个执行一个客户端的回调，包括Callback、BatchCallback、DeadLetterSink和Delivery。
+// 回调在单独的goroutine中执行，不占用sender和发送线程，因此回调中可以再推入日志，
+// 慢的回调也不会拖慢其他日志池。队列本身没有上限，但排队的日志仍占用MaxBufferedBytes的预算，
+// 设置了预算时，回调跟不上会使推入方等待或丢弃日志。没有待执行的回调时goroutine退出。
+type callbackQueue struct {
+	mu      sync.Mutex
+	pending []func()
+	running bool
+}
+
+// push把f排入队列。
+func (q *callbackQueue) push(f func()) {
+	q.mu.Lock()
+	q.pending = append(q.pending, f)
+	if q.running {
+		q.mu.Unlock()
+		return
+	}
+	q.running = true
+	q.mu.Unlock()
+	go q.run()
+}
+
+func (q *callbackQueue) run() {
+	for {
+		q.mu.Lock()
+		fs := q.pending
+		q.pending = nil
+		if len(fs) == 0 {
+			q.running = false
+			q.mu.Unlock()
+			return
+		}
+		q.mu.Unlock()
+		for i, f := range fs {
+			f()
+			fs[i] = nil
+		}
+	}
+}
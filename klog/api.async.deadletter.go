@@ -0,0 +1,268 @@
+package klog
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/ks3sdk/klog-go-sdk/internal/apierr"
+	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"sync"
+)
+
+// DeadLetter是一条被AsyncClient放弃的日志。
+type DeadLetter struct {
+	ProjectName string
+	LogPoolName string
+	Log         *pb.Log
+	// 放弃的原因
+	Code    string
+	Message string
+}
+
+// DeadLetterSink接收AsyncClient放弃的日志，包括：
+// 不合法的日志(DeliveryRejectedInvalid)、因日志池不存在被丢弃的日志(DeliveryDroppedPoolMissing)，
+// 以及重试耗尽等发送失败的日志(DeliveryFailed)。
+// 因发送队列满或客户端关闭而未发送的日志不会交给DeadLetterSink。
+// PutDeadLetter在Callback之前调用，可能被多个goroutine同时调用。
+type DeadLetterSink interface {
+	PutDeadLetter(letter *DeadLetter) error
+}
+
+func newDeadLetter(projectName, logPoolName string, log *pb.Log, err error) *DeadLetter {
+	letter := &DeadLetter{
+		ProjectName: projectName,
+		LogPoolName: logPoolName,
+		Log:         log,
+		Code:        "UnknownError",
+		Message:     err.Error(),
+	}
+	if e, ok := err.(*apierr.BaseError); ok {
+		letter.Code = e.Code()
+		letter.Message = e.Message()
+	}
+	return letter
+}
+
+// isDeadLetter判断以err结束的日志是否应交给DeadLetterSink。
+func isDeadLetter(err error) bool {
+	switch ClassifyDelivery(err) {
+	case DeliveryRejectedInvalid, DeliveryDroppedPoolMissing, DeliveryFailed:
+		return true
+	default:
+		return false
+	}
+}
+
+// FileDeadLetterSink写入的单条记录的大小上限
+const MaxDeadLetterSize = MaxLogSize * 4 // byte
+
+// FileDeadLetterSink把放弃的日志追加到本地文件中。
+//
+// 每条记录的格式为：uvarint长度 + 记录内容。记录内容依次为
+// 错误码、项目名、日志池名、错误信息（均为uvarint长度 + 字符串），以及序列化后的pb.Log。
+// 记录内容超过MaxDeadLetterSize的日志不写入，PutDeadLetter返回错误。
+// 可使用ReadDeadLetters读取，使用ReinjectDeadLetters重新发送。
+type FileDeadLetterSink struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewFileDeadLetterSink以追加方式打开path。
+func NewFileDeadLetterSink(path string) (*FileDeadLetterSink, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileDeadLetterSink{file: file}, nil
+}
+
+func (s *FileDeadLetterSink) PutDeadLetter(letter *DeadLetter) error {
+	payload, err := proto.Marshal(letter.Log)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	for _, field := range []string{letter.Code, letter.ProjectName, letter.LogPoolName, letter.Message} {
+		body = appendUvarintBytes(body, []byte(field))
+	}
+	body = append(body, payload...)
+	if len(body) > MaxDeadLetterSize {
+		return fmt.Errorf("the size of this dead letter is %d and the MaxDeadLetterSize is %d", len(body), MaxDeadLetterSize)
+	}
+	record := appendUvarintBytes(nil, body)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.file.Write(record)
+	return err
+}
+
+// Close关闭文件。
+func (s *FileDeadLetterSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+func appendUvarintBytes(dst []byte, b []byte) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(lenBuf[:], uint64(len(b)))
+	dst = append(dst, lenBuf[:n]...)
+	return append(dst, b...)
+}
+
+// ReadDeadLetters按顺序读取FileDeadLetterSink写入的文件，对每条记录调用fn。
+// fn返回错误时停止读取并返回该错误。
+// 过大或无法解析的记录被跳过，读完后返回描述被跳过记录的错误；文件末尾不完整的记录结束读取。
+func ReadDeadLetters(path string, fn func(letter *DeadLetter) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var skipped int
+	var skipErr error
+	skip := func(index int, err error) {
+		if skipped == 0 {
+			skipErr = fmt.Errorf("dead letter %d: %s", index, err.Error())
+		}
+		skipped++
+	}
+	done := func() error {
+		if skipped > 0 {
+			return fmt.Errorf("%d dead letters skipped, the first one is %s", skipped, skipErr.Error())
+		}
+		return nil
+	}
+
+	r := bufio.NewReader(file)
+	for index := 0; ; index++ {
+		length, err := binary.ReadUvarint(r)
+		if err == io.EOF {
+			return done()
+		} else if err != nil {
+			skip(index, err)
+			return done()
+		}
+		if length > MaxDeadLetterSize {
+			skip(index, fmt.Errorf("invalid record length %d", length))
+			if length > math.MaxInt64 {
+				return done()
+			}
+			if _, err = io.CopyN(ioutil.Discard, r, int64(length)); err != nil {
+				return done()
+			}
+			continue
+		}
+		body := make([]byte, length)
+		if _, err = io.ReadFull(r, body); err != nil {
+			skip(index, err)
+			return done()
+		}
+
+		letter, err := decodeDeadLetter(body)
+		if err != nil {
+			skip(index, err)
+			continue
+		}
+		if err = fn(letter); err != nil {
+			return err
+		}
+	}
+}
+
+func decodeDeadLetter(body []byte) (*DeadLetter, error) {
+	var fields [4]string
+	for i := range fields {
+		length, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < length {
+			return nil, io.ErrUnexpectedEOF
+		}
+		fields[i] = string(body[n : n+int(length)])
+		body = body[n+int(length):]
+	}
+	log := &pb.Log{}
+	if err := proto.Unmarshal(body, log); err != nil {
+		return nil, err
+	}
+	return &DeadLetter{
+		Code:        fields[0],
+		ProjectName: fields[1],
+		LogPoolName: fields[2],
+		Message:     fields[3],
+		Log:         log,
+	}, nil
+}
+
+// DeadLetterReinjector接收ReinjectDeadLetters重新推入的日志，*AsyncClient和*AsyncMultiPoolClient都实现了该接口。
+type DeadLetterReinjector interface {
+	// ReinjectDeadLetter推入letter中的日志，不接受这条日志时返回false。
+	ReinjectDeadLetter(letter *DeadLetter) bool
+}
+
+// ReinjectDeadLetter把letter中的日志推入客户端。letter属于其他项目或日志池时不推入，返回false。
+func (o *AsyncClient) ReinjectDeadLetter(letter *DeadLetter) bool {
+	if letter.ProjectName != o.ProjectName || letter.LogPoolName != o.LogPoolName {
+		return false
+	}
+	o.PushLog(letter.Log)
+	return true
+}
+
+// ReinjectDeadLetter把letter中的日志推入其原来的项目和日志池。
+func (o *AsyncMultiPoolClient) ReinjectDeadLetter(letter *DeadLetter) bool {
+	o.PushLog(letter.ProjectName, letter.LogPoolName, letter.Log)
+	return true
+}
+
+// ReinjectDeadLetters把FileDeadLetterSink写入的日志重新推入client，发往原来的项目和日志池。
+// client为*AsyncClient时只推入属于其项目和日志池的日志。
+// 返回推入的条数。文件不会被修改，确认发送成功后可由调用者删除。
+func ReinjectDeadLetters(path string, client DeadLetterReinjector) (int, error) {
+	count := 0
+	err := ReadDeadLetters(path, func(letter *DeadLetter) error {
+		if client.ReinjectDeadLetter(letter) {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
+
+// 转发到备用日志池时附加的字段
+const (
+	DeadLetterProjectKey = "__dead_letter_project__"
+	DeadLetterPoolKey    = "__dead_letter_pool__"
+	DeadLetterCodeKey    = "__dead_letter_code__"
+)
+
+// FallbackPoolDeadLetterSink把放弃的日志转发到另一个项目和日志池，
+// 并附加原项目名、原日志池名和错误码字段。
+type FallbackPoolDeadLetterSink struct {
+	Client *AsyncClient
+}
+
+// NewFallbackPoolDeadLetterSink返回转发到client的DeadLetterSink。
+// client应使用与原客户端不同的项目或日志池，并且不应把这个sink设置为自己的DeadLetterSink。
+func NewFallbackPoolDeadLetterSink(client *AsyncClient) *FallbackPoolDeadLetterSink {
+	return &FallbackPoolDeadLetterSink{Client: client}
+}
+
+func (s *FallbackPoolDeadLetterSink) PutDeadLetter(letter *DeadLetter) error {
+	log := proto.Clone(letter.Log).(*pb.Log)
+	log.Contents = append(log.Contents,
+		&pb.Log_Content{Key: DeadLetterProjectKey, Value: letter.ProjectName},
+		&pb.Log_Content{Key: DeadLetterPoolKey, Value: letter.LogPoolName},
+		&pb.Log_Content{Key: DeadLetterCodeKey, Value: letter.Code},
+	)
+	_, err := s.Client.PushLogContext(context.Background(), log)
+	return err
+}
@@ -0,0 +1,145 @@
+package klog
+
+import (
+	"context"
+	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileDeadLetterSink(t *testing.T) {
+	a := assert.New(t)
+	dir, err := ioutil.TempDir("", "klog-dead-letter")
+	a.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead.letters")
+
+	server := newFakeServer()
+	defer server.Close()
+	server.setHandle(func(_ *pb.LogGroup, r *http.Request) (int, string) {
+		if r.URL.Query().Get("LogPoolName") == "missing" {
+			return http.StatusNotFound, ProjectOrLogPoolNotExist
+		}
+		return 0, ""
+	})
+
+	sink, err := NewFileDeadLetterSink(path)
+	a.Nil(err)
+	client := NewAsyncMultiPoolClient(&AsyncMultiPoolClientOptions{
+		DropIfPoolNotExists: true,
+		DeadLetterSink:      sink,
+	}, server.config())
+	client.PushLog("project", "missing", makeTestLog("lost"))
+	client.PushLog("project", "pool", makeTestLog(strings.Repeat("x", MaxLogSize)))
+	client.PushLog("project", "pool", makeTestLog("sent"))
+	a.Nil(client.Close(context.Background()))
+	a.Nil(sink.Close())
+	a.Equal(1, server.received())
+
+	var letters []*DeadLetter
+	a.Nil(ReadDeadLetters(path, func(letter *DeadLetter) error {
+		letters = append(letters, letter)
+		return nil
+	}))
+	a.Len(letters, 2)
+	codes := map[string]*DeadLetter{}
+	for _, letter := range letters {
+		codes[letter.Code] = letter
+	}
+	a.Equal("missing", codes[ProjectOrLogPoolNotExist].LogPoolName)
+	a.Equal("lost", codes[ProjectOrLogPoolNotExist].Log.Contents[0].Value)
+	a.Equal("pool", codes[MaxLogSizeExceeded].LogPoolName)
+
+	// 问题修复后重新发送
+	server.setHandle(nil)
+	retry := NewAsyncMultiPoolClient(&AsyncMultiPoolClientOptions{}, server.config())
+	count, err := ReinjectDeadLetters(path, retry)
+	a.Nil(err)
+	a.Equal(2, count)
+	a.Nil(retry.Close(context.Background()))
+	// 过大的日志仍然被丢弃，日志池已存在的日志发送成功
+	a.Equal(2, server.received())
+}
+
+func TestReadDeadLettersSkipsBadRecords(t *testing.T) {
+	a := assert.New(t)
+	dir, err := ioutil.TempDir("", "klog-dead-letter")
+	a.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead.letters")
+
+	sink, err := NewFileDeadLetterSink(path)
+	a.Nil(err)
+	letter := func(pool, value string) *DeadLetter {
+		return &DeadLetter{ProjectName: "project", LogPoolName: pool, Log: makeTestLog(value), Code: InternalServerError}
+	}
+	a.Nil(sink.PutDeadLetter(letter("pool", "first")))
+	// 超过上限的记录不写入
+	a.Error(sink.PutDeadLetter(letter("pool", strings.Repeat("x", MaxDeadLetterSize))))
+	// 过大和无法解析的记录
+	oversize := make([]byte, MaxDeadLetterSize+1)
+	_, err = sink.file.Write(appendUvarintBytes(nil, oversize))
+	a.Nil(err)
+	_, err = sink.file.Write(appendUvarintBytes(nil, []byte("garbage")))
+	a.Nil(err)
+	a.Nil(sink.PutDeadLetter(letter("other", "second")))
+	a.Nil(sink.PutDeadLetter(letter("pool", "third")))
+	a.Nil(sink.Close())
+
+	var values []string
+	err = ReadDeadLetters(path, func(letter *DeadLetter) error {
+		values = append(values, letter.Log.Contents[0].Value)
+		return nil
+	})
+	a.True(strings.HasPrefix(err.Error(), "2 dead letters skipped"))
+	a.Equal([]string{"first", "second", "third"}, values)
+
+	// 单个AsyncClient只重新推入自己日志池的日志
+	server := newFakeServer()
+	defer server.Close()
+	client := NewAsyncClient(&AsyncClientOptions{ProjectName: "project", LogPoolName: "pool"}, server.config())
+	count, err := ReinjectDeadLetters(path, client)
+	a.Error(err)
+	a.Equal(2, count)
+	a.Nil(client.Close(context.Background()))
+	a.Equal(2, server.received())
+}
+
+func TestFallbackPoolDeadLetterSink(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	server.setHandle(func(_ *pb.LogGroup, r *http.Request) (int, string) {
+		if r.URL.Query().Get("LogPoolName") == "missing" {
+			return http.StatusNotFound, ProjectOrLogPoolNotExist
+		}
+		return 0, ""
+	})
+
+	fallback := NewAsyncClient(&AsyncClientOptions{ProjectName: "project", LogPoolName: "fallback"}, server.config())
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName:         "project",
+		LogPoolName:         "missing",
+		DropIfPoolNotExists: true,
+		DeadLetterSink:      NewFallbackPoolDeadLetterSink(fallback),
+	}, server.config())
+	client.PushLog(makeTestLog("value"))
+	a.Nil(client.Close(context.Background()))
+	a.Nil(fallback.Close(context.Background()))
+
+	a.Equal(1, server.received())
+	server.mu.Lock()
+	contents := map[string]string{}
+	for _, c := range server.logs[0].Contents {
+		contents[c.Key] = c.Value
+	}
+	server.mu.Unlock()
+	a.Equal("value", contents["key"])
+	a.Equal("missing", contents[DeadLetterPoolKey])
+	a.Equal(ProjectOrLogPoolNotExist, contents[DeadLetterCodeKey])
+}
@@ -0,0 +1,125 @@
+package klog
+
+import (
+	"context"
+)
+
+// DeliveryOutcome是一条日志的最终处理结果。
+type DeliveryOutcome int
+
+const (
+	// 尚未处理完
+	DeliveryPending DeliveryOutcome = iota
+	// 发送成功
+	DeliverySent
+	// 用户未开通KLog或日志池不存在，根据DropIfPoolNotExists被丢弃
+	DeliveryDroppedPoolMissing
+	// 日志不合法（超过大小限制、非UTF-8等），被丢弃
+	DeliveryRejectedInvalid
+	// 发送队列或落盘空间已满，被丢弃
+	DeliveryOverflow
+	// 客户端已关闭，未被发送
+	DeliveryShutdown
+	// 其他原因导致发送失败
+	DeliveryFailed
+)
+
+func (o DeliveryOutcome) String() string {
+	switch o {
+	case DeliveryPending:
+		return "pending"
+	case DeliverySent:
+		return "sent"
+	case DeliveryDroppedPoolMissing:
+		return "dropped-pool-missing"
+	case DeliveryRejectedInvalid:
+		return "rejected-invalid"
+	case DeliveryOverflow:
+		return "overflow"
+	case DeliveryShutdown:
+		return "shutdown"
+	default:
+		return "failed"
+	}
+}
+
+// ClassifyDelivery把Callback收到的错误归类为DeliveryOutcome。
+func ClassifyDelivery(err error) DeliveryOutcome {
+	switch {
+	case err == nil:
+		return DeliverySent
+	case IsError(err, UserNotExist) || IsError(err, ProjectOrLogPoolNotExist):
+		return DeliveryDroppedPoolMissing
+	case IsError(err, MaxKeyCountExceeded) || IsError(err, MaxKeySizeExceeded) || IsError(err, MaxValueSizeExceeded) ||
+		IsError(err, MaxLogSizeExceeded) || IsError(err, InvalidUtf8InKey) || IsError(err, InvalidUtf8InValue) ||
+		IsError(err, PostBodyInvalid) || IsError(err, PostBodyTooLarge) || IsError(err, MaxBulkSizeExceeded):
+		return DeliveryRejectedInvalid
+	case IsError(err, QueueOverflow) || IsError(err, SpoolFull):
+		return DeliveryOverflow
+	case IsError(err, ClientShutdown):
+		return DeliveryShutdown
+	default:
+		return DeliveryFailed
+	}
+}
+
+// Delivery用于跟踪PushLogWithResult推入的一条日志。
+type Delivery struct {
+	seqNo   uint64
+	done    chan struct{}
+	err     error
+	outcome DeliveryOutcome
+}
+
+func newDelivery(seqNo uint64) *Delivery {
+	return &Delivery{
+		seqNo: seqNo,
+		done:  make(chan struct{}),
+	}
+}
+
+// SeqNo返回这条日志的seq no.，与Callback中的seqNo相同。
+func (d *Delivery) SeqNo() uint64 {
+	return d.seqNo
+}
+
+// Done返回一个在这条日志处理完后关闭的channel。
+func (d *Delivery) Done() <-chan struct{} {
+	return d.done
+}
+
+// Err在Done关闭之前返回nil，之后返回与Callback相同的错误。
+func (d *Delivery) Err() error {
+	select {
+	case <-d.done:
+		return d.err
+	default:
+		return nil
+	}
+}
+
+// Outcome在Done关闭之前返回DeliveryPending，之后返回处理结果。
+func (d *Delivery) Outcome() DeliveryOutcome {
+	select {
+	case <-d.done:
+		return d.outcome
+	default:
+		return DeliveryPending
+	}
+}
+
+// Wait等待这条日志处理完，返回Err()。ctx先结束时返回ctx.Err()。
+func (d *Delivery) Wait(ctx context.Context) error {
+	select {
+	case <-d.done:
+		return d.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Delivery) resolve(err error) {
+	d.err = err
+	d.outcome = ClassifyDelivery(err)
+	close(d.done)
+}
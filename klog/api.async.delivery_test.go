@@ -0,0 +1,59 @@
+package klog
+
+import (
+	"context"
+	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDelivery(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	server.setHandle(func(_ *pb.LogGroup, r *http.Request) (int, string) {
+		if r.URL.Query().Get("LogPoolName") == "missing" {
+			return http.StatusNotFound, ProjectOrLogPoolNotExist
+		}
+		return 0, ""
+	})
+
+	client := NewAsyncMultiPoolClient(&AsyncMultiPoolClientOptions{
+		DropIfPoolNotExists: true,
+		Linger:              10 * time.Millisecond,
+	}, server.config())
+
+	sent := client.PushLogWithResult("project", "pool", makeTestLog("value"))
+	a.Equal(DeliveryPending, sent.Outcome())
+	a.Nil(sent.Err())
+	missing := client.PushLogWithResult("project", "missing", makeTestLog("value"))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a.Nil(sent.Wait(ctx))
+	a.Equal(DeliverySent, sent.Outcome())
+	a.True(IsError(missing.Wait(ctx), ProjectOrLogPoolNotExist))
+	a.Equal(DeliveryDroppedPoolMissing, missing.Outcome())
+
+	client.Stop()
+	closed := client.PushLogWithResult("project", "pool", makeTestLog("value"))
+	<-closed.Done()
+	a.Equal(DeliveryShutdown, closed.Outcome())
+}
+
+func TestDeliveryWaitContext(t *testing.T) {
+	d := newDelivery(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, d.Wait(ctx))
+}
+
+func TestClassifyDelivery(t *testing.T) {
+	a := assert.New(t)
+	a.Equal(DeliveryRejectedInvalid, ClassifyDelivery(CheckLog(&pb.Log{Contents: []*pb.Log_Content{{Key: "k", Value: "\xff"}}})))
+	a.Equal(DeliveryOverflow, ClassifyDelivery(errQueueOverflow(nil)))
+	a.Equal(DeliveryFailed, ClassifyDelivery(context.DeadlineExceeded))
+	a.Equal("dropped-pool-missing", DeliveryDroppedPoolMissing.String())
+}
@@ -6,8 +6,10 @@ import (
 	"github.com/ks3sdk/klog-go-sdk/internal/apierr"
 	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
 	"github.com/ks3sdk/klog-go-sdk/service"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 )
@@ -22,21 +24,108 @@ const (
 	LogGroupSizeToSend = 2000000 // byte
 )
 
+// OverflowPolicy决定发送队列满时PushLog的行为。
+type OverflowPolicy int
+
+const (
+	// 阻塞，直到队列有空位。默认策略。
+	OverflowBlock OverflowPolicy = iota
+	// 丢弃新推入的日志
+	OverflowDropNewest
+	// 丢弃队列中最早的日志，为新日志腾出空位
+	OverflowDropOldest
+	// 最多阻塞OverflowTimeout，超时后丢弃新推入的日志
+	OverflowBlockWithTimeout
+)
+
+// OverflowBlockWithTimeout策略默认的等待时间
+const DefaultOverflowTimeout = time.Second
+
+// 批量发送的默认条件：buf中的日志达到LogGroupSizeToSend字节或MaxBulkSize条，
+// 或者距上次封装超过DefaultLinger时，封装成一个batch。
+const DefaultLinger = 2 * time.Second
+
+// Ordering决定多个发送线程之间的发送顺序。
+type Ordering int
+
+const (
+	// 多个batch可以同时发送，日志到达服务端的顺序可能与推入顺序不同。默认策略。
+	OrderingBestEffort Ordering = iota
+	// 同时只发送一个batch，日志按推入顺序到达服务端，SendWorkers不生效。
+	OrderingStrict
+)
+
 type AsyncClient struct {
+	// pending记录已推入但尚未处理完的日志数，lastPushAt记录最近一次推入的时间(UnixNano)。
+	// 放在最前面，保证32位平台上atomic操作的对齐。
+	pending    int64
+	lastPushAt int64
+
 	ProjectName string
 	LogPoolName string
 	KLog        *Klog
 
 	dropIfLogPoolNotExists bool
 	callback               func(*pb.Log, uint64, error)
+	batchCallback          func(*BatchResult)
+	overflowPolicy         OverflowPolicy
+	overflowTimeout        time.Duration
+	sendWorkers            int
+	linger                 time.Duration
+	maxBatchBytes          int
+	maxBatchCount          int
+	retryPolicy            RetryPolicy
+	maxLogAge              time.Duration
+	deadLetterSink         DeadLetterSink
+	oversizePolicy         OversizePolicy
+	spool                  *spool
+	replay                 []*spooledLog
 	ch                     chan *event
-	lastSendAt             time.Time
-	idBuf                  []uint64
-	buf                    []*pb.Log
-	bufSize                int
-	wg                     *sync.WaitGroup
-	ctx                    context.Context
-	cancel                 context.CancelFunc
+	budget                 *budget
+	sharedBudget           *budget
+	sender                 *sender
+	// 复制发送时，primary是负责封装的客户端，replicas是其他目标的客户端，destination是本目标的名称
+	primary     *AsyncClient
+	replicas    []*AsyncClient
+	destination string
+	wg          *sync.WaitGroup
+	ctx         context.Context
+	cancel      context.CancelFunc
+
+	// notified为1时，sender已收到ch中有新日志的通知，尚未读取
+	notified int32
+
+	// callbacks按顺序执行回调。stopped在客户端停止、回调全部执行完后关闭
+	callbacks callbackQueue
+	stopped   chan struct{}
+
+	// 以下字段只在sender的goroutine中访问。
+	// sending记录已交给发送线程或正在等待重试的batch数，retrying记录正在等待重试的batch。
+	lastSendAt time.Time
+	buf        []*event
+	bufSize    int
+	sealed     []*batch
+	sending    int
+	retrying   map[*batch]struct{}
+	queued     bool
+	attached   bool
+	draining   bool
+	aborted    bool
+	detached   bool
+	// stopWatch取消对熔断器状态的监听
+	stopWatch func()
+
+	// mu保护closed。pushers记录正在写入ch的PushLog调用，
+	// 关闭时需要等待它们结束，才能保证ch中的日志被完整地取出。
+	mu      sync.RWMutex
+	closed  bool
+	closing chan struct{}
+	pushers sync.WaitGroup
+	runDone chan struct{}
+
+	// inflight记录已封装但尚未处理完的batch，Flush等待其中的batch全部处理完
+	inflightMu sync.Mutex
+	inflight   map[*batch]struct{}
 }
 
 type AsyncClientOptions struct {
@@ -46,19 +135,242 @@ type AsyncClientOptions struct {
 	// Callback: 每条日志在发送成功或丢弃时调用。
 	// log: 日志数据
 	// seqNo: 日志顺序号
-	// err: nil表示发送成功。非nil表示错误，并且该条日志被丢弃。
-	Callback            func(log *pb.Log, seqNo uint64, err error)
+	// err: nil表示发送成功。非nil表示错误，并且该条日志被丢弃。可用ClassifyDelivery归类。
+	// Callback和BatchCallback在客户端的回调goroutine中按顺序逐个调用，不会被同时调用，也不阻塞发送，回调中可以再推入日志。
+	// 例外是推入时未能放入发送队列的日志（QueueOverflow、SpoolFull、ClientShutdown等），
+	// 它们在调用PushLog的goroutine中直接回调，可能与其他回调同时进行。
+	Callback func(log *pb.Log, seqNo uint64, err error)
+	// DropIfPoolNotExists: 用户未开通KLog或日志池不存在时丢弃日志，不再重试。
+	// 被丢弃的日志以UserNotExist或ProjectOrLogPoolNotExist错误调用Callback。
 	DropIfPoolNotExists bool
 	QueueSize           int
+
+	// BatchCallback: 每个batch发送成功或放弃时调用，在batch中各条日志的Callback之后调用。
+	// batch因被服务端拒绝而拆分时，对拆分后的每个batch分别调用。
+	BatchCallback func(result *BatchResult)
+
+	// OverflowPolicy: 发送队列满时的处理方式，默认为OverflowBlock。
+	// 被丢弃的日志以QueueOverflow错误调用Callback。
+	OverflowPolicy OverflowPolicy
+	// OverflowTimeout: OverflowBlockWithTimeout策略的最长等待时间，默认为DefaultOverflowTimeout。
+	OverflowTimeout time.Duration
+
+	// SpoolDir: 非空时启用落盘。日志在推入时先写入该目录，发送成功或被丢弃后删除。
+	// 进程崩溃或关闭时未发送的日志，在下次以同一目录新建客户端时重新发送，并分配新的seq no.。
+	// 同一目录同时只能被一个客户端使用。
+	// 序列化后超过MaxLogSize两倍的日志不落盘，只保存在内存中，由OversizePolicy处理。
+	SpoolDir string
+	// SpoolMaxBytes: 落盘数据的总大小上限，默认为DefaultSpoolMaxBytes。
+	// 超出时新推入的日志以SpoolFull错误调用Callback。
+	SpoolMaxBytes int64
+	// SpoolSegmentBytes: 单个落盘文件的大小上限，默认为DefaultSpoolSegmentBytes。
+	SpoolSegmentBytes int64
+
+	// SendWorkers: 同时发送的请求数，默认为1。
+	// 大于1时，一个请求变慢或等待重试不影响其他batch的封装和发送。
+	SendWorkers int
+	// Ordering: 多个发送线程之间的顺序，默认为OrderingBestEffort。
+	Ordering Ordering
+
+	// Linger: 日志在buf中等待凑成batch的最长时间，默认为DefaultLinger。负数同样使用默认值。
+	Linger time.Duration
+	// MaxBatchBytes: 一个batch的最大字节数，默认为LogGroupSizeToSend，不能超过MaxLogGroupSize。
+	// 负数或超过MaxLogGroupSize时使用默认值。
+	MaxBatchBytes int
+	// MaxBatchCount: 一个batch的最大日志条数，默认为MaxBulkSize，不能超过MaxBulkSize。
+	// 负数或超过MaxBulkSize时使用默认值。
+	MaxBatchCount int
+
+	// RetryPolicy: 发送失败后的重试策略。默认随机退避，最长等待120秒，永不放弃。
+	// 可使用ExponentialRetryPolicy、FixedRetryPolicy或自定义的实现。
+	RetryPolicy RetryPolicy
+	// MaxLogAge: 日志从推入起最多等待发送的时间，0或负数表示不限制。
+	// 重试时已超时的日志以MaxLogAgeExceeded错误调用Callback，不再重试。
+	MaxLogAge time.Duration
+
+	// DeadLetterSink: 接收被放弃的日志，例如FileDeadLetterSink或FallbackPoolDeadLetterSink。
+	DeadLetterSink DeadLetterSink
+
+	// OversizePolicy: 超过MaxLogSize，或含有超过MaxValueSize的value的日志的处理方式，默认为OversizeDrop。
+	OversizePolicy OversizePolicy
+
+	// MaxBufferedBytes: 已推入但尚未处理完的日志的总字节数上限（按proto.Size计算），0或负数表示不限制。
+	// 超出时按OverflowPolicy处理，被丢弃的日志以QueueOverflow错误调用Callback。
+	// 日志占用的字节在调用其Callback之前才释放，因此回调中以阻塞的OverflowPolicy推入日志时，
+	// 预算可能被等待回调的日志占满而一直等待，回调中应使用TryPushLog或带超时的PushLogContext。
+	MaxBufferedBytes int64
+}
+
+// Validate检查选项的取值范围。
+// NewAsyncClient不会因不合法的选项而失败，它记录错误日志，并按各选项的说明使用默认值或不限制。
+// 需要拒绝不合法的配置时，应在创建客户端之前调用Validate。
+func (o *AsyncClientOptions) Validate() error {
+	if o.Linger < 0 {
+		return apierr.New(InvalidOptions, fmt.Sprintf("Linger[%s] should not be negative", o.Linger), nil)
+	}
+	if o.MaxBatchBytes < 0 || o.MaxBatchBytes > MaxLogGroupSize {
+		return apierr.New(InvalidOptions, fmt.Sprintf("MaxBatchBytes[%d] should be between 0 and %d", o.MaxBatchBytes, MaxLogGroupSize), nil)
+	}
+	if o.MaxBatchCount < 0 || o.MaxBatchCount > MaxBulkSize {
+		return apierr.New(InvalidOptions, fmt.Sprintf("MaxBatchCount[%d] should be between 0 and %d", o.MaxBatchCount, MaxBulkSize), nil)
+	}
+	if o.MaxLogAge < 0 {
+		return apierr.New(InvalidOptions, fmt.Sprintf("MaxLogAge[%s] should not be negative", o.MaxLogAge), nil)
+	}
+	if o.MaxBufferedBytes < 0 {
+		return apierr.New(InvalidOptions, fmt.Sprintf("MaxBufferedBytes[%d] should not be negative", o.MaxBufferedBytes), nil)
+	}
+	return nil
+}
+
+// BatchResult描述一个batch的发送结果。
+type BatchResult struct {
+	ProjectName string
+	LogPoolName string
+
+	// batch中最终的日志及其seq no.，这些日志的Callback收到的错误即Err。
+	// 发送过程中因不合法而被剔除的日志不在其中。
+	LogGroup *pb.LogGroup
+	SeqNos   []uint64
+
+	// 最后一次请求的X-KSC-REQUEST-ID
+	RequestID string
+	// HTTP请求的总次数，包括service层的重试
+	Attempts int
+	// 最后一次请求压缩前和压缩后的请求体字节数
+	RawSize        int
+	CompressedSize int
+	// 从第一次发送到结束的耗时
+	Duration time.Duration
+	// nil表示发送成功
+	Err error
 }
 
 type event struct {
-	seqNo uint64
-	log   *pb.Log
+	seqNo    uint64
+	log      *pb.Log
+	size     int
+	pushedAt time.Time
+	segment  *segment
+	delivery *Delivery
+	// 占用的字节预算
+	reserved int64
+	// 被拆分的日志的分片所属的组
+	group *splitGroup
+	// 复制发送的日志在各目标的副本所属的组
+	replica *replicaGroup
+}
+
+// batch是一组已经封装好、等待一次PutLogs发送的日志。
+type batch struct {
+	client  *AsyncClient
+	events  []*event
+	size    int
+	waiters []*flushWaiter
+
+	// 序列化后的请求体，events变化时释放
+	body *batchBody
+
+	// 以下记录跨越多次发送的状态
+	result  *BatchResult
+	start   time.Time
+	retries int
+	err     error
+	next    attemptResult
+	delay   time.Duration
+	halves  []*batch
+	timer   *time.Timer
+	// 因熔断而暂停重试，熔断器不再打开时提前重试
+	paused bool
+}
+
+func (o *AsyncClient) newBatch(events []*event) *batch {
+	b := &batch{client: o, events: events}
+	for _, ev := range events {
+		b.size += ev.size
+	}
+	return b
+}
+
+func (b *batch) logGroup() *pb.LogGroup {
+	logs := make([]*pb.Log, len(b.events))
+	for i, ev := range b.events {
+		logs[i] = ev.log
+	}
+	return &pb.LogGroup{Logs: logs}
+}
+
+// batchBody是序列化后的请求体，使用service的缓冲池。
+// 复制发送时多个目标的batch共用同一个batchBody，全部释放后才归还缓冲区。
+type batchBody struct {
+	buf  *[]byte
+	refs int32
+}
+
+// encode把batch序列化到缓冲池的缓冲区中。各日志的大小在推入时已计算，据此预留足够的容量。
+func (b *batch) encode() (*batchBody, error) {
+	need := 0
+	for _, ev := range b.events {
+		need += 1 + protowire.SizeVarint(uint64(ev.size)) + ev.size
+	}
+	buf := service.GetBuffer()
+	if cap(*buf) < need {
+		*buf = make([]byte, 0, need)
+	}
+	body, err := proto.MarshalOptions{}.MarshalAppend(*buf, b.logGroup())
+	if err != nil {
+		service.PutBuffer(buf)
+		return nil, err
+	}
+	*buf = body
+	return &batchBody{buf: buf, refs: 1}, nil
+}
+
+func (body *batchBody) bytes() []byte {
+	return *body.buf
+}
+
+func (body *batchBody) retain() *batchBody {
+	atomic.AddInt32(&body.refs, 1)
+	return body
+}
+
+// release释放一个引用，没有引用时归还缓冲区。
+func (body *batchBody) release() {
+	if atomic.AddInt32(&body.refs, -1) == 0 {
+		service.PutBuffer(body.buf)
+	}
+}
+
+// releaseBody释放batch对请求体的引用。发送中的请求另外持有引用。
+func (b *batch) releaseBody() {
+	if b.body != nil {
+		b.body.release()
+		b.body = nil
+	}
+}
+
+type flushRequest struct {
+	client *AsyncClient
+	final  bool
+	done   chan *flushWaiter
+}
+
+// flushWaiter在Flush时已封装的batch全部处理完后关闭done。
+type flushWaiter struct {
+	remaining int
+	done      chan struct{}
 }
 
 // 新建异步发送客户端
 func NewAsyncClient(options *AsyncClientOptions, kLogConfig *service.Config) *AsyncClient {
+	return newAsyncClient(options, kLogConfig, nil, nil)
+}
+
+// newAsyncClient新建异步发送客户端。s为nil时，客户端使用自己的sender。
+// s非nil时，调用方设置好客户端后需调用wake，使sender开始处理它。
+// shared为与其他客户端共用的字节预算，可以为nil。
+func newAsyncClient(options *AsyncClientOptions, kLogConfig *service.Config, s *sender, shared *budget) *AsyncClient {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	queueSize := 2048
@@ -66,150 +378,793 @@ func NewAsyncClient(options *AsyncClientOptions, kLogConfig *service.Config) *As
 		queueSize = options.QueueSize
 	}
 
+	overflowTimeout := DefaultOverflowTimeout
+	if options.OverflowTimeout > 0 {
+		overflowTimeout = options.OverflowTimeout
+	}
+
+	sendWorkers := 1
+	if options.SendWorkers > 0 && options.Ordering != OrderingStrict {
+		sendWorkers = options.SendWorkers
+	}
+
+	linger := DefaultLinger
+	if options.Linger > 0 {
+		linger = options.Linger
+	}
+	maxBatchBytes := LogGroupSizeToSend
+	if options.MaxBatchBytes > 0 && options.MaxBatchBytes <= MaxLogGroupSize {
+		maxBatchBytes = options.MaxBatchBytes
+	}
+	maxBatchCount := MaxBulkSize
+	if options.MaxBatchCount > 0 && options.MaxBatchCount <= MaxBulkSize {
+		maxBatchCount = options.MaxBatchCount
+	}
+
+	var retryPolicy RetryPolicy = defaultRetryPolicy{}
+	if options.RetryPolicy != nil {
+		retryPolicy = options.RetryPolicy
+	}
+
 	c := &AsyncClient{
 		ProjectName:            options.ProjectName,
 		LogPoolName:            options.LogPoolName,
 		KLog:                   New(kLogConfig),
 		callback:               options.Callback,
+		batchCallback:          options.BatchCallback,
 		dropIfLogPoolNotExists: options.DropIfPoolNotExists,
+		overflowPolicy:         options.OverflowPolicy,
+		overflowTimeout:        overflowTimeout,
+		sendWorkers:            sendWorkers,
+		linger:                 linger,
+		maxBatchBytes:          maxBatchBytes,
+		maxBatchCount:          maxBatchCount,
+		retryPolicy:            retryPolicy,
+		maxLogAge:              options.MaxLogAge,
+		deadLetterSink:         options.DeadLetterSink,
+		oversizePolicy:         options.OversizePolicy,
 		ch:                     make(chan *event, queueSize),
-		buf:                    make([]*pb.Log, 0),
-		lastSendAt:             time.Now(),
+		budget:                 newBudget(options.MaxBufferedBytes),
+		sharedBudget:           shared,
 		wg:                     new(sync.WaitGroup),
 		ctx:                    ctx,
 		cancel:                 cancel,
+		buf:                    make([]*event, 0),
+		lastSendAt:             time.Now(),
+		retrying:               make(map[*batch]struct{}),
+		closing:                make(chan struct{}),
+		runDone:                make(chan struct{}),
+		stopped:                make(chan struct{}),
+		inflight:               make(map[*batch]struct{}),
+	}
+
+	if err := options.Validate(); err != nil {
+		c.KLog.Config.Logger.Errorf("klog.AsyncClient: invalid options, default values are used instead, project=%s, pool=%s, err=%s", c.ProjectName, c.LogPoolName, err.Error())
+	}
+
+	if options.SpoolDir != "" {
+		maxBytes := int64(DefaultSpoolMaxBytes)
+		if options.SpoolMaxBytes > 0 {
+			maxBytes = options.SpoolMaxBytes
+		}
+		segmentBytes := int64(DefaultSpoolSegmentBytes)
+		if options.SpoolSegmentBytes > 0 {
+			segmentBytes = options.SpoolSegmentBytes
+		}
+		var err error
+		c.spool, c.replay, err = openSpool(options.SpoolDir, maxBytes, segmentBytes, c.KLog.Config.Logger)
+		if err != nil {
+			// 落盘不可用时退化为仅使用内存
+			c.KLog.Config.Logger.Errorf("klog.AsyncClient: failed to open spool, logs are kept in memory only, dir=%s, err=%s", options.SpoolDir, err.Error())
+		}
+		c.pending = int64(len(c.replay))
+	}
+	c.lastPushAt = time.Now().UnixNano()
+
+	c.wg.Add(1)
+	c.sender = s
+	if s == nil {
+		c.sender = newSender(sendWorkers, lingerTick(linger), c)
+		go c.sender.run()
+		c.wake()
 	}
-	go c.run()
 	return c
 }
 
 // 异步发送一条log，返回这条log的seq no.。
 // seq no.用来在callback中跟踪发送情况。
 // seq no.只在进程内有效。
+// 发送队列满时按OverflowPolicy处理。
+// 客户端关闭后推入的日志不会被发送，而是以ClientShutdown错误调用callback。
 func (o *AsyncClient) PushLog(log *pb.Log) uint64 {
-	ev := &event{
-		seqNo: service.GetSeqNo(),
-		log:   log,
-	}
-	o.ch <- ev
+	ev := newEvent(log)
+	_ = o.push(context.Background(), ev, o.overflowPolicy)
 	return ev.seqNo
 }
 
+// TryPushLog同PushLog，但从不阻塞。
+// 发送队列已满时丢弃这条日志，以QueueOverflow错误调用callback，并返回false。
+func (o *AsyncClient) TryPushLog(log *pb.Log) (uint64, bool) {
+	ev := newEvent(log)
+	err := o.push(context.Background(), ev, OverflowDropNewest)
+	return ev.seqNo, err == nil
+}
+
+// PushLogContext同PushLog，但阻塞等待时会在ctx结束时放弃。
+// 日志未能进入发送队列时返回非nil的错误，该错误同样会传给callback。
+func (o *AsyncClient) PushLogContext(ctx context.Context, log *pb.Log) (uint64, error) {
+	ev := newEvent(log)
+	err := o.push(ctx, ev, o.overflowPolicy)
+	return ev.seqNo, err
+}
+
+// PushLogWithResult同PushLog，返回用于等待和查询这条日志处理结果的Delivery。
+func (o *AsyncClient) PushLogWithResult(log *pb.Log) *Delivery {
+	ev := newEvent(log)
+	ev.delivery = newDelivery(ev.seqNo)
+	_ = o.push(context.Background(), ev, o.overflowPolicy)
+	return ev.delivery
+}
+
+func newEvent(log *pb.Log) *event {
+	return &event{
+		seqNo:    service.GetSeqNo(),
+		log:      log,
+		pushedAt: time.Now(),
+	}
+}
+
+// push把ev放入发送队列。未能放入时以相应的错误回调并返回该错误。
+func (o *AsyncClient) push(ctx context.Context, ev *event, policy OverflowPolicy) error {
+	if !o.enter() {
+		err := errClientClosed()
+		o.deliver(ev, err)
+		return err
+	}
+	return o.enqueue(ctx, ev, policy)
+}
+
+// enter登记一次推入，客户端已关闭时返回false。
+// 返回true时，调用方必须接着调用enqueue。
+func (o *AsyncClient) enter() bool {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	if o.closed {
+		return false
+	}
+	o.pushers.Add(1)
+	atomic.AddInt64(&o.pending, 1)
+	atomic.StoreInt64(&o.lastPushAt, time.Now().UnixNano())
+	return true
+}
+
+// enqueue把已登记的ev放入发送队列。未能放入时以相应的错误回调并返回该错误。
+func (o *AsyncClient) enqueue(ctx context.Context, ev *event, policy OverflowPolicy) error {
+	defer o.pushers.Done()
+	defer o.wake()
+
+	if policy == OverflowBlockWithTimeout {
+		// 等待预算和等待队列空位的总时间不超过OverflowTimeout
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, ev.pushedAt.Add(o.overflowTimeout))
+		defer cancel()
+	}
+	if o.budget != nil || o.sharedBudget != nil {
+		ev.size = proto.Size(ev.log)
+		if err := o.reserve(ctx, ev, policy); err != nil {
+			o.refuse(ev, err)
+			return err
+		}
+	}
+
+	if o.spool != nil {
+		seg, err := o.spool.append(ev.log)
+		if IsError(err, SpoolFull) {
+			o.refuse(ev, err)
+			return err
+		} else if err != nil {
+			o.KLog.Config.Logger.Errorf("klog.AsyncClient.Spool: failed to write, the log is kept in memory only, project=%s, pool=%s, err=%s", o.ProjectName, o.LogPoolName, err.Error())
+		}
+		ev.segment = seg
+	}
+
+	select {
+	case o.ch <- ev:
+		return nil
+	default:
+	}
+
+	var err error
+	switch policy {
+	case OverflowDropNewest:
+		err = errQueueOverflow(nil)
+	case OverflowDropOldest:
+		// 每丢弃一条最早的日志后，先尝试放入，避免多丢
+		for err == nil {
+			select {
+			case o.ch <- ev:
+				return nil
+			default:
+			}
+			select {
+			case old := <-o.ch:
+				o.refuse(old, errQueueOverflow(nil))
+			case <-o.closing:
+				err = errClientClosed()
+			default:
+			}
+		}
+	default:
+		select {
+		case o.ch <- ev:
+			return nil
+		case <-o.closing:
+			err = errClientClosed()
+		case <-ctx.Done():
+			err = errQueueOverflow(ctx.Err())
+		}
+	}
+	o.refuse(ev, err)
+	return err
+}
+
 // 停止发送。
-// 调用Stop()之后，AsyncClient等待当前发送请求完成，然后停止。
+// 调用Stop()之后，AsyncClient不再接受新的日志，中断当前的发送和重试，然后停止。
+// 尚未发送成功的日志以ClientShutdown错误调用callback。
+// wait为false时不等待sender处理停止请求，立即返回。
+// 需要把已推入的日志尽量发送出去时，应使用Close()。
 func (o *AsyncClient) Stop(wait bool) {
-	o.cancel()
-	if wait {
+	o.shutdown()
+	if !wait {
+		go o.abort()
+		return
+	}
+	o.abort()
+	o.wg.Wait()
+}
+
+// Flush把调用之前推入的日志全部发送出去，在发送完成或ctx结束时返回。
+// ctx结束时，未发送的日志仍留在客户端中，稍后继续发送，返回ctx.Err()。
+func (o *AsyncClient) Flush(ctx context.Context) error {
+	return o.requestFlush(ctx, false)
+}
+
+// Close停止接受新的日志，把已推入的日志全部发送出去后停止客户端。
+// ctx结束时Close立即返回ctx.Err()，不等待sender和回调结束。仍未发送成功的日志随后在后台
+// 以ClientShutdown错误调用callback，需要等待这些回调时，可在Close返回后调用Stop(true)。
+func (o *AsyncClient) Close(ctx context.Context) error {
+	o.shutdown()
+	err := o.requestFlush(ctx, true)
+	stopped := make(chan struct{})
+	go func() {
+		o.abort()
 		o.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return err
+	case <-ctx.Done():
+	}
+	select {
+	case <-stopped:
+		return err
+	default:
+		return ctx.Err()
 	}
 }
 
-func (o *AsyncClient) run() {
-	o.wg.Add(1)
-	defer o.wg.Done()
-	ticker := time.NewTicker(time.Duration(200) * time.Millisecond)
-	for {
+// wake通知sender读取ch中的日志。wake不阻塞，可以在回调和sender的goroutine中调用。
+func (o *AsyncClient) wake() {
+	if atomic.CompareAndSwapInt32(&o.notified, 0, 1) {
+		o.sender.wake(o)
+	}
+}
+
+// abort中断发送和重试，尚未发送成功的日志以ClientShutdown错误回调。
+func (o *AsyncClient) abort() {
+	o.cancel()
+	select {
+	case o.sender.abortCh <- o:
+	case <-o.runDone:
+	}
+}
+
+// retireIfIdle在客户端超过idle没有推入日志、且没有待处理的日志时，使其不再接受新的日志，并返回true。
+// 之后仍需调用Close释放客户端。
+func (o *AsyncClient) retireIfIdle(idle time.Duration) bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.closed || atomic.LoadInt64(&o.pending) > 0 {
+		return false
+	}
+	if time.Since(time.Unix(0, atomic.LoadInt64(&o.lastPushAt))) < idle {
+		return false
+	}
+	o.closed = true
+	close(o.closing)
+	return true
+}
+
+// shutdown使PushLog不再接受新的日志，并等待正在进行的PushLog调用结束。
+func (o *AsyncClient) shutdown() {
+	o.mu.Lock()
+	if !o.closed {
+		o.closed = true
+		close(o.closing)
+	}
+	o.mu.Unlock()
+	o.pushers.Wait()
+}
+
+func (o *AsyncClient) requestFlush(ctx context.Context, final bool) error {
+	req := &flushRequest{
+		client: o,
+		final:  final,
+		done:   make(chan *flushWaiter, 1),
+	}
+	select {
+	case o.sender.flushCh <- req:
+	case <-o.runDone:
+		if final {
+			return nil
+		}
+		return errClientClosed()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	w := <-req.done
+	select {
+	case <-w.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// add把一条日志放入buf，buf达到发送条件时封装成batch。
+func (o *AsyncClient) add(ev *event) {
+	if ev.size == 0 {
+		ev.size = proto.Size(ev.log)
+	}
+	if o.oversizePolicy != OversizeDrop && isOversize(ev.log, ev.size) {
+		o.addOversize(ev)
+		return
+	}
+	if ev.size > MaxLogSize {
+		// 这条log过大，需要抛弃
+		o.finish(ev, apierr.New(MaxLogSizeExceeded, fmt.Sprintf("the size of this log is %d and the MaxLogSize is %d", ev.size, MaxLogSize), nil))
+		return
+	}
+	o.addToBuf(ev)
+}
+
+// addOversize按OversizePolicy截断或拆分过大的日志。
+func (o *AsyncClient) addOversize(ev *event) {
+	switch o.oversizePolicy {
+	case OversizeTruncate:
+		log, err := truncateLog(ev.log)
+		if err != nil {
+			o.finish(ev, err)
+			return
+		}
+		ev.log = log
+		ev.size = proto.Size(log)
+		o.addToBuf(ev)
+	case OversizeSplit:
+		chunks, err := splitLog(ev.log)
+		if err != nil {
+			o.finish(ev, err)
+			return
+		}
+		group := &splitGroup{origin: ev, remaining: len(chunks)}
+		for _, chunk := range chunks {
+			o.addToBuf(&event{
+				seqNo:    ev.seqNo,
+				log:      chunk,
+				size:     proto.Size(chunk),
+				pushedAt: ev.pushedAt,
+				group:    group,
+			})
+		}
+	}
+}
+
+func (o *AsyncClient) addToBuf(ev *event) {
+	if ev.size+o.bufSize > o.maxBatchBytes {
+		// 这条log与buf中的log size之和，超过限制，需要先把buf中的封装起来
+		o.seal()
+	}
+
+	// 处理这条log
+	o.buf = append(o.buf, ev)
+	o.bufSize += ev.size
+	if o.bufSize >= o.maxBatchBytes || len(o.buf) >= o.maxBatchCount {
+		o.seal()
+	}
+}
+
+// lingerTick返回检查linger的时间间隔。
+func lingerTick(linger time.Duration) time.Duration {
+	tick := linger / 10
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+	return tick
+}
+
+func (o *AsyncClient) seal() {
+	if len(o.buf) == 0 {
+		return
+	}
+	b := &batch{client: o, events: o.buf, size: o.bufSize}
+	o.inflightMu.Lock()
+	o.inflight[b] = struct{}{}
+	o.inflightMu.Unlock()
+
+	o.sealed = append(o.sealed, b)
+	if len(o.replicas) > 0 {
+		o.replicate(b)
+	}
+	o.buf = make([]*event, 0)
+	o.bufSize = 0
+	o.lastSendAt = time.Now()
+}
+
+// fill在待发送的batch没有积压时读取ch中已有的日志。
+// 积压时暂停读取，使PushLog按OverflowPolicy处理。
+func (o *AsyncClient) fill() {
+	for n := len(o.ch); n > 0 && len(o.sealed) < o.sendWorkers && !o.replicasBacklogged(); n-- {
 		select {
-		case <-o.ctx.Done():
+		case ev := <-o.ch:
+			o.add(ev)
+		default:
 			return
+		}
+	}
+}
+
+// drain取出ch中已有的日志。
+func (o *AsyncClient) drain() {
+	for {
+		select {
 		case ev := <-o.ch:
-			size := proto.Size(ev.log)
-			if size > MaxLogSize {
-				// 这条log过大，需要抛弃
-				o.doCallback(ev.log, ev.seqNo, apierr.New("MaxLogSizeExceeded", fmt.Sprintf("the size of this log is %d and the MaxLogSize is %d", size, MaxLogSize), nil))
-				continue
-			} else if size+o.bufSize > MaxLogGroupSize {
-				// 这条log与buf中的log size之和，超过限制，需要先把buf中的发送出去
-				o.send()
-			}
+			o.add(ev)
+		default:
+			return
+		}
+	}
+}
 
-			// 处理这条log
-			o.buf = append(o.buf, ev.log)
-			o.idBuf = append(o.idBuf, ev.seqNo)
-			o.bufSize += size
-			if o.bufSize >= LogGroupSizeToSend || len(o.buf) >= MaxBulkSize {
-				o.send()
-			}
-		case <-ticker.C:
-			if time.Now().Sub(o.lastSendAt) > time.Duration(2)*time.Second && len(o.buf) > 0 {
-				o.send()
+// newFlushWaiter返回一个在当前所有已封装的batch处理完、并且它们的回调执行完后关闭的flushWaiter。
+func (o *AsyncClient) newFlushWaiter() *flushWaiter {
+	w := &flushWaiter{done: make(chan struct{})}
+	o.inflightMu.Lock()
+	for b := range o.inflight {
+		b.waiters = append(b.waiters, w)
+		w.remaining++
+	}
+	o.inflightMu.Unlock()
+	if w.remaining == 0 {
+		// 已处理完的batch的回调可能仍在排队，排在它们之后关闭
+		o.callbacks.push(func() {
+			close(w.done)
+		})
+	}
+	return w
+}
+
+// batchDone在batch中的日志全部回调后调用。等待batch的Flush在这些回调执行完后返回。
+func (o *AsyncClient) batchDone(b *batch) {
+	b.releaseBody()
+	o.inflightMu.Lock()
+	delete(o.inflight, b)
+	waiters := b.waiters
+	b.waiters = nil
+	o.inflightMu.Unlock()
+	if len(waiters) == 0 {
+		return
+	}
+	o.callbacks.push(func() {
+		o.inflightMu.Lock()
+		for _, w := range waiters {
+			w.remaining--
+			if w.remaining == 0 {
+				close(w.done)
 			}
 		}
-	}
+		o.inflightMu.Unlock()
+	})
 }
 
-func (o *AsyncClient) send() {
-	var count int
-	var err error
-	defer func() {
-		for i := range o.buf {
-			o.doCallback(o.buf[i], o.idBuf[i], err)
-		}
-		o.bufSize = 0
-		o.buf = o.buf[:0]
-		o.idBuf = o.idBuf[:0]
-		o.lastSendAt = time.Now()
-	}()
+// replaceBatch用拆分后的batch替换inflight中的原batch，等待原batch的Flush改为等待拆分后的batch。
+func (o *AsyncClient) replaceBatch(b *batch, halves []*batch) {
+	o.inflightMu.Lock()
+	delete(o.inflight, b)
+	for _, half := range halves {
+		o.inflight[half] = struct{}{}
+		half.waiters = append(half.waiters, b.waiters...)
+	}
+	for _, w := range b.waiters {
+		w.remaining += len(halves) - 1
+	}
+	b.waiters = nil
+	o.inflightMu.Unlock()
+}
 
+// abandon以ClientShutdown错误回调所有尚未交给发送线程的日志。
+// 启用落盘时，这些日志仍保留在落盘文件中。
+func (o *AsyncClient) abandon(cause error) {
+	err := errShutdown(cause)
+	for _, b := range o.sealed {
+		o.finishBatch(b, err)
+		o.batchDone(b)
+	}
+	o.sealed = nil
+	for _, ev := range o.buf {
+		o.finish(ev, err)
+	}
+	o.buf = o.buf[:0]
+	o.bufSize = 0
 	for {
-		lg := &pb.LogGroup{Logs: o.buf}
+		select {
+		case ev := <-o.ch:
+			o.finish(ev, err)
+		default:
+			return
+		}
+	}
+}
 
-		// 发送请求
-		err = o.KLog.PutLogs(lg, o.ProjectName, o.LogPoolName)
+// attempt发送一次batch，返回下一步的处理方式。
+// batch处理完时，已回调其中的每条日志；需要重试时，等待由sender负责，不占用发送线程。
+func (o *AsyncClient) attempt(b *batch) attemptResult {
+	if b.result == nil {
+		b.result = &BatchResult{
+			ProjectName: o.ProjectName,
+			LogPoolName: o.LogPoolName,
+		}
+		b.start = time.Now()
+	}
+	result := b.result
+
+	var err error
+	for {
+		// 发送请求，请求体在重试之间复用
+		var req *service.Request
+		if b.body == nil {
+			b.body, err = b.encode()
+		}
+		if err == nil {
+			result.RawSize = len(b.body.bytes())
+			req, err = o.KLog.putLogsBody(o.ctx, b.body.bytes(), b.body.retain().release, o.ProjectName, o.LogPoolName)
+		}
+		if req != nil {
+			result.RequestID = req.RequestID
+			result.Attempts += int(req.RetryCount) + 1
+			result.CompressedSize = int(req.HTTPRequest.ContentLength)
+		}
 		if err == nil {
 			// 成功
-			return
+			break
+		}
+		if o.ctx.Err() != nil {
+			// 客户端已停止，正在发送的请求被中断
+			err = errShutdown(err)
+			break
 		}
 
 		if IsError(err, MaxKeyCountExceeded) || IsError(err, MaxKeySizeExceeded) || IsError(err, MaxValueSizeExceeded) || IsError(err, PostBodyInvalid) || err.Error() == "string field contains invalid UTF-8" {
 			// 存在有问题的日志，而且不可能发出去，丢弃后重试
-			o.removeInvalidLogs()
-
-			if len(o.buf) == 0 {
-				return
-			}
-			if err.Error() == "string field contains invalid UTF-8" {
+			if o.removeInvalidLogs(b) > 0 {
+				if len(b.events) == 0 {
+					break
+				}
 				continue
 			}
 
+			// 本地检查没有发现问题，逐步二分找出被拒绝的日志
+			if len(b.events) == 1 {
+				break
+			}
+			return o.bisect(b, err)
+		} else if IsError(err, PostBodyTooLarge) || IsError(err, MaxBulkSizeExceeded) {
+			// 请求过大，拆分后重新发送
+			if len(b.events) == 1 {
+				break
+			}
+			return o.bisect(b, err)
 		} else if IsError(err, UserNotExist) || IsError(err, ProjectOrLogPoolNotExist) {
 			// 用户未开通kLog或日志池不存在
 			if o.dropIfLogPoolNotExists {
-				// 根据用户配置，丢弃但标记成功
-				return
+				// 根据用户配置丢弃
+				break
+			}
+		}
+
+		if IsError(err, CircuitOpen) {
+			// 熔断期间暂停重试，不计入重试次数，熔断器不再打开时由sender恢复发送
+			o.expireLogs(b, err)
+			if len(b.events) == 0 {
+				break
+			}
+			b.err = err
+			b.delay = service.DefaultCircuitCooldown
+			if breaker := o.KLog.Config.CircuitBreaker; breaker != nil {
+				b.delay = breaker.Cooldown()
 			}
+			b.paused = true
+			return attemptRetry
+		}
+
+		// 其他问题按RetryPolicy重试
+		b.retries++
+		o.expireLogs(b, err)
+		if len(b.events) == 0 {
+			break
+		}
+		delay, ok := o.retryPolicy.NextDelay(b.retries, time.Now().Sub(b.start), err)
+		if !ok {
+			o.KLog.Config.Logger.Errorf("klog.AsyncClient.Send: retry exhausted, project=%s, pool=%s, attempts=%d, err=%s", o.ProjectName, o.LogPoolName, b.retries, err.Error())
+			err = apierr.New(RetryExhausted, fmt.Sprintf("gave up after %d attempts", b.retries), err)
+			break
 		}
 
 		o.KLog.Config.Logger.Errorf("klog.AsyncClient.Send: sleep then retry, project=%s, pool=%s, err=%s", o.ProjectName, o.LogPoolName, err.Error())
+		b.err = err
+		b.delay = delay
+		return attemptRetry
+	}
 
-		// 其他问题都需要重试
-		count++
-		timer := service.MakeRandomTimer(count)
-		select {
-		case <-timer.C:
-			continue
-		case <-o.ctx.Done():
-			// 收到停止信号
-			o.KLog.Config.Logger.Infof("INFO AsyncClient.Send: cancel received, stop retry, project=%s, pool=%s", o.ProjectName, o.LogPoolName)
-			return
+	o.complete(b, err)
+	return attemptDone
+}
+
+// complete以err回调batch中的每条日志，然后调用BatchCallback。
+func (o *AsyncClient) complete(b *batch, err error) {
+	result := b.result
+	if result == nil {
+		result = &BatchResult{
+			ProjectName: o.ProjectName,
+			LogPoolName: o.LogPoolName,
+		}
+		b.start = time.Now()
+	}
+	result.LogGroup = b.logGroup()
+	result.SeqNos = make([]uint64, len(b.events))
+	for i, ev := range b.events {
+		result.SeqNos[i] = ev.seqNo
+	}
+	result.Duration = time.Now().Sub(b.start)
+	result.Err = err
+
+	o.finishBatch(b, err)
+	if o.batchCallback != nil {
+		o.callbacks.push(func() {
+			o.batchCallback(result)
+		})
+	}
+}
+
+// expireLogs以MaxLogAgeExceeded错误回调batch中超过MaxLogAge的日志，并把它们移出batch。
+func (o *AsyncClient) expireLogs(b *batch, cause error) {
+	if o.maxLogAge <= 0 {
+		return
+	}
+	now := time.Now()
+	events := b.events[:0]
+	for _, ev := range b.events {
+		if now.Sub(ev.pushedAt) > o.maxLogAge {
+			o.finish(ev, apierr.New(MaxLogAgeExceeded, fmt.Sprintf("the log was not sent within %s", o.maxLogAge), cause))
+		} else {
+			events = append(events, ev)
 		}
 	}
+	for i := len(events); i < len(b.events); i++ {
+		b.events[i] = nil
+	}
+	if len(events) < len(b.events) {
+		b.releaseBody()
+	}
+	b.events = events
 }
 
-func (o *AsyncClient) removeInvalidLogs() {
+// removeInvalidLogs回调并移除batch中不能通过CheckLog的日志，返回移除的条数。
+func (o *AsyncClient) removeInvalidLogs(b *batch) int {
 	var err error
-	newBuf := make([]*pb.Log, 0)
-	newIdBuf := make([]uint64, 0)
-	for i, log := range o.buf {
-		if err = CheckLog(log); err != nil {
-			o.doCallback(log, o.idBuf[i], err)
+	events := make([]*event, 0, len(b.events))
+	size := 0
+	for _, ev := range b.events {
+		if err = CheckLog(ev.log); err != nil {
+			o.finish(ev, err)
 		} else {
-			newBuf = append(newBuf, log)
-			newIdBuf = append(newIdBuf, o.idBuf[i])
+			events = append(events, ev)
+			size += ev.size
 		}
 	}
-	o.buf = newBuf
-	o.idBuf = newIdBuf
+	removed := len(b.events) - len(events)
+	if removed > 0 {
+		b.releaseBody()
+	}
+	b.events = events
+	b.size = size
+	return removed
+}
+
+// bisect把被服务端拒绝的batch拆成两半，分别发送。
+// 被拒绝的原因只在于部分日志时，其余日志仍能发送成功，有问题的日志最终被单独拒绝。
+func (o *AsyncClient) bisect(b *batch, cause error) attemptResult {
+	o.KLog.Config.Logger.Infof("INFO AsyncClient.Send: batch rejected, split and resend, project=%s, pool=%s, count=%d, err=%s", o.ProjectName, o.LogPoolName, len(b.events), cause.Error())
+	mid := len(b.events) / 2
+	b.halves = []*batch{
+		o.newBatch(append([]*event(nil), b.events[:mid]...)),
+		o.newBatch(append([]*event(nil), b.events[mid:]...)),
+	}
+	b.events = nil
+	b.size = 0
+	b.err = cause
+	b.releaseBody()
+	return attemptSplit
+}
+
+// finish结束一条日志的处理：释放其占用的预算，然后在回调队列中确认其落盘记录并回调。
+// 因客户端关闭而未发送的日志不确认，以便下次启动时重新发送。
+// 分片全部处理完后，才结束被拆分的原日志。
+func (o *AsyncClient) finish(ev *event, err error) {
+	o.settle(ev, err, o.callbacks.push)
+}
+
+// refuse同finish，但在调用方的goroutine中直接回调。用于推入时未能放入发送队列的日志。
+func (o *AsyncClient) refuse(ev *event, err error) {
+	o.settle(ev, err, func(f func()) {
+		f()
+	})
+}
+
+// settle结束一条日志的处理，回调由run执行。
+func (o *AsyncClient) settle(ev *event, err error, run func(func())) {
+	if ev.group != nil {
+		if ev.group.done(err) {
+			o.settle(ev.group.origin, ev.group.err, run)
+		}
+		return
+	}
+	atomic.AddInt64(&o.pending, -1)
+	// 预算在回调前才释放，排队等待回调的日志同样计入MaxBufferedBytes，回调慢时推入方会等待
+	run(func() {
+		if err != nil && o.deadLetterSink != nil && isDeadLetter(err) {
+			if sinkErr := o.deadLetterSink.PutDeadLetter(newDeadLetter(o.ProjectName, o.LogPoolName, ev.log, err)); sinkErr != nil {
+				o.KLog.Config.Logger.Errorf("klog.AsyncClient: failed to put dead letter, project=%s, pool=%s, err=%s", o.ProjectName, o.LogPoolName, sinkErr.Error())
+			}
+		}
+		// 写入死信之后才确认落盘记录，进程在此之间退出时日志会被重新发送，不会丢失
+		if ev.segment != nil && !IsError(err, ClientShutdown) {
+			o.spool.ack(ev.segment)
+		}
+		o.unreserve(ev)
+		o.deliver(ev, err)
+	})
+}
+
+// deliver把日志的处理结果通知给callback和Delivery。
+// 复制发送的日志交给其replicaGroup汇总。
+func (o *AsyncClient) deliver(ev *event, err error) {
+	if ev.replica != nil {
+		ev.replica.done(o.destination, err)
+		return
+	}
+	o.doCallback(ev.log, ev.seqNo, err)
+	if ev.delivery != nil {
+		ev.delivery.resolve(err)
+	}
+}
+
+func (o *AsyncClient) finishBatch(b *batch, err error) {
+	for _, ev := range b.events {
+		o.finish(ev, err)
+	}
+	b.events = nil
 }
 
 func (o *AsyncClient) doCallback(log *pb.Log, seqNo uint64, err error) {
@@ -218,6 +1173,18 @@ func (o *AsyncClient) doCallback(log *pb.Log, seqNo uint64, err error) {
 	}
 }
 
+func errClientClosed() error {
+	return apierr.New(ClientShutdown, "the client is closed and does not accept new logs", nil)
+}
+
+func errShutdown(cause error) error {
+	return apierr.New(ClientShutdown, "the client was stopped before the log could be sent", cause)
+}
+
+func errQueueOverflow(cause error) error {
+	return apierr.New(QueueOverflow, "the send queue is full, log dropped", cause)
+}
+
 func CheckLog(log *pb.Log) error {
 	contents := log.GetContents()
 	if len(contents) > MaxKeyCount {
@@ -1,60 +1,472 @@
 package klog
 
 import (
+	"context"
 	"fmt"
 	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
 	"github.com/ks3sdk/klog-go-sdk/service"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Stop()等待各日志池发送剩余日志的最长时间
+const DefaultStopTimeout = 30 * time.Second
+
+// 所有日志池共用的发送线程数的默认值
+const DefaultTotalSendWorkers = 8
+
 type AsyncMultiPoolClient struct {
+	// closed为1时不再创建新的客户端。放在最前面，保证atomic操作的对齐。
+	closed int32
+
 	AsyncClients sync.Map
 	KLogConfig   *service.Config
 	Options      *AsyncMultiPoolClientOptions
+
+	// mu保证同一日志池只创建一个客户端。
+	// removing记录已从AsyncClients移除、但尚未停止的客户端，同一日志池的新客户端要等它停止后才能创建，
+	// 以免两个客户端同时使用同一个落盘目录。
+	mu       sync.Mutex
+	removing map[string]*AsyncClient
+
+	// sender和budget由所有日志池共用
+	sender *sender
+	budget *budget
+
+	stopEvict chan struct{}
+	evictDone chan struct{}
+}
+
+// PoolClientInfo描述AsyncMultiPoolClient中一个日志池的客户端。
+type PoolClientInfo struct {
+	ProjectName string
+	LogPoolName string
+	// 最近一次推入日志的时间
+	LastPushAt time.Time
+	// 已推入但尚未处理完的日志数
+	Pending int
 }
 
 type AsyncMultiPoolClientOptions struct {
+	// Callback和BatchCallback: 同AsyncClientOptions。同一日志池的回调按顺序逐个调用，
+	// 不同日志池的回调可能被同时调用。
 	Callback            func(*pb.Log, uint64, error)
+	BatchCallback       func(*BatchResult)
 	DropIfPoolNotExists bool
 	QueueSize           int
+	OverflowPolicy      OverflowPolicy
+	OverflowTimeout     time.Duration
+
+	// SpoolDir: 非空时启用落盘，每个日志池使用其下的"<项目名>/<日志池名>"子目录。
+	// 新建客户端时，子目录中未发送的日志会被重新发送。
+	// SpoolMaxBytes和SpoolSegmentBytes对每个日志池分别生效。
+	SpoolDir          string
+	SpoolMaxBytes     int64
+	SpoolSegmentBytes int64
+
+	// TotalSendWorkers: 所有日志池共用的发送线程数，默认为DefaultTotalSendWorkers。
+	// 有batch待发送的日志池轮流使用发送线程，等待重试的batch不占用发送线程。
+	TotalSendWorkers int
+	// SendWorkers: 每个日志池同时发送的batch数的上限，默认为1。
+	// Ordering: 同AsyncClientOptions，对每个日志池分别生效。
+	SendWorkers int
+	Ordering    Ordering
+
+	// 同AsyncClientOptions，对每个日志池分别生效
+	Linger        time.Duration
+	MaxBatchBytes int
+	MaxBatchCount int
+	RetryPolicy   RetryPolicy
+	MaxLogAge     time.Duration
+
+	// DeadLetterSink: 同AsyncClientOptions，所有日志池共用
+	DeadLetterSink DeadLetterSink
+
+	// 同AsyncClientOptions
+	OversizePolicy OversizePolicy
+
+	// MaxBufferedBytes: 同AsyncClientOptions，对每个日志池分别生效。
+	// MaxTotalBufferedBytes: 所有日志池已推入但尚未处理完的日志的总字节数上限，0表示不限制。
+	// 超出时按OverflowPolicy处理，OverflowDropOldest只丢弃同一日志池中的日志。
+	MaxBufferedBytes      int64
+	MaxTotalBufferedBytes int64
+
+	// PoolOptions: 为单个日志池调整选项（选填）。
+	// 新建日志池的客户端时调用，options已按以上选项填好，可按options.ProjectName和options.LogPoolName修改其中的任意选项，
+	// 例如不允许丢弃日志的日志池使用OverflowBlock，调试用的日志池使用较小的QueueSize和OverflowDropNewest。
+	// 不能修改ProjectName和LogPoolName。各日志池可以使用不同的Linger，共用的sender按其中最短的Linger检查。
+	PoolOptions func(options *AsyncClientOptions)
+
+	// IdleTimeout: 日志池超过这段时间没有推入日志、并且日志已全部处理完时，停止并移除它的客户端。
+	// 之后再向该日志池推入日志时重新创建。默认为0，不移除。
+	IdleTimeout time.Duration
 }
 
 func NewAsyncMultiPoolClient(options *AsyncMultiPoolClientOptions, kLogConfig *service.Config) *AsyncMultiPoolClient {
-	return &AsyncMultiPoolClient{
+	if kLogConfig != nil && len(kLogConfig.Endpoints) > 0 && kLogConfig.EndpointHealth == nil {
+		// 各日志池共用地址的健康状态，一个地址被隔离后所有日志池都不再使用它
+		cfg := *kLogConfig
+		cfg.EndpointHealth = service.NewEndpointHealth(service.EndpointHealthOptions{
+			FailureThreshold: kLogConfig.EndpointFailureThreshold,
+			EjectDuration:    kLogConfig.EndpointEjectDuration,
+		})
+		kLogConfig = &cfg
+	}
+	c := &AsyncMultiPoolClient{
 		AsyncClients: sync.Map{},
 		KLogConfig:   kLogConfig,
 		Options:      options,
+		removing:     make(map[string]*AsyncClient),
+		budget:       newBudget(options.MaxTotalBufferedBytes),
+		stopEvict:    make(chan struct{}),
+		evictDone:    make(chan struct{}),
+	}
+	workers := DefaultTotalSendWorkers
+	if options.TotalSendWorkers > 0 {
+		workers = options.TotalSendWorkers
+	}
+	linger := DefaultLinger
+	if options.Linger > 0 {
+		linger = options.Linger
+	}
+	c.sender = newSender(workers, lingerTick(linger), nil)
+	go c.sender.run()
+
+	if options.SpoolDir != "" {
+		c.resumeSpooledPools()
+	}
+	if options.IdleTimeout > 0 {
+		go c.evictLoop()
+	} else {
+		close(c.evictDone)
+	}
+	return c
+}
+
+// resumeSpooledPools为SpoolDir中留有数据的日志池创建客户端，使其重新发送。
+func (o *AsyncMultiPoolClient) resumeSpooledPools() {
+	projects, _ := ioutil.ReadDir(o.Options.SpoolDir)
+	for _, project := range projects {
+		if !project.IsDir() {
+			continue
+		}
+		projectName, err := url.PathUnescape(project.Name())
+		if err != nil {
+			continue
+		}
+		pools, _ := ioutil.ReadDir(filepath.Join(o.Options.SpoolDir, project.Name()))
+		for _, pool := range pools {
+			if !pool.IsDir() {
+				continue
+			}
+			if logPoolName, err := url.PathUnescape(pool.Name()); err == nil {
+				o.client(projectName, logPoolName)
+			}
+		}
 	}
 }
 
 func (o *AsyncMultiPoolClient) PushLog(projectName, logPoolName string, log *pb.Log) uint64 {
-	var client *AsyncClient
-	key := fmt.Sprintf("%s\001%s", projectName, logPoolName)
-
-	if itf, ok := o.AsyncClients.Load(key); !ok {
-		client = NewAsyncClient(&AsyncClientOptions{
-			ProjectName:         projectName,
-			LogPoolName:         logPoolName,
-			Callback:            o.Options.Callback,
-			DropIfPoolNotExists: o.Options.DropIfPoolNotExists,
-			QueueSize:           o.Options.QueueSize,
-		}, o.KLogConfig)
-		o.AsyncClients.Store(key, client)
-	} else {
-		client, _ = itf.(*AsyncClient)
+	ev := newEvent(log)
+	_ = o.push(context.Background(), projectName, logPoolName, ev, false)
+	return ev.seqNo
+}
+
+// PushLogWithResult同AsyncClient.PushLogWithResult()。
+func (o *AsyncMultiPoolClient) PushLogWithResult(projectName, logPoolName string, log *pb.Log) *Delivery {
+	ev := newEvent(log)
+	ev.delivery = newDelivery(ev.seqNo)
+	_ = o.push(context.Background(), projectName, logPoolName, ev, false)
+	return ev.delivery
+}
+
+// TryPushLog同AsyncClient.TryPushLog()。
+func (o *AsyncMultiPoolClient) TryPushLog(projectName, logPoolName string, log *pb.Log) (uint64, bool) {
+	ev := newEvent(log)
+	err := o.push(context.Background(), projectName, logPoolName, ev, true)
+	return ev.seqNo, err == nil
+}
+
+// PushLogContext同AsyncClient.PushLogContext()。
+func (o *AsyncMultiPoolClient) PushLogContext(ctx context.Context, projectName, logPoolName string, log *pb.Log) (uint64, error) {
+	ev := newEvent(log)
+	err := o.push(ctx, projectName, logPoolName, ev, false)
+	return ev.seqNo, err
+}
+
+// push把ev交给日志池的客户端。客户端恰好因空闲被移除时，改用新建的客户端。
+// noWait为true时，发送队列满则直接丢弃。
+func (o *AsyncMultiPoolClient) push(ctx context.Context, projectName, logPoolName string, ev *event, noWait bool) error {
+	for {
+		client := o.client(projectName, logPoolName)
+		if client == nil {
+			break
+		}
+		if client.enter() {
+			policy := client.overflowPolicy
+			if noWait {
+				policy = OverflowDropNewest
+			}
+			return client.enqueue(ctx, ev, policy)
+		}
 	}
-	return client.PushLog(log)
+
+	err := errClientClosed()
+	o.report(ev, err)
+	return err
 }
 
-func (o *AsyncMultiPoolClient) Stop() {
+// report把未能交给日志池客户端的日志的结果通知给callback和Delivery。
+func (o *AsyncMultiPoolClient) report(ev *event, err error) {
+	if o.Options.Callback != nil {
+		o.Options.Callback(ev.log, ev.seqNo, err)
+	}
+	if ev.delivery != nil {
+		ev.delivery.resolve(err)
+	}
+}
+
+func poolKey(projectName, logPoolName string) string {
+	return fmt.Sprintf("%s\001%s", projectName, logPoolName)
+}
+
+// client返回日志池的客户端，不存在时创建。AsyncMultiPoolClient已关闭时返回nil。
+func (o *AsyncMultiPoolClient) client(projectName, logPoolName string) *AsyncClient {
+	if atomic.LoadInt32(&o.closed) == 1 {
+		return nil
+	}
+	key := poolKey(projectName, logPoolName)
+	if itf, ok := o.AsyncClients.Load(key); ok {
+		return itf.(*AsyncClient)
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for {
+		if atomic.LoadInt32(&o.closed) == 1 {
+			return nil
+		}
+		if itf, ok := o.AsyncClients.Load(key); ok {
+			return itf.(*AsyncClient)
+		}
+		old := o.removing[key]
+		if old == nil {
+			break
+		}
+		// 等待同一日志池的上一个客户端停止
+		o.mu.Unlock()
+		<-old.stopped
+		o.mu.Lock()
+	}
+
+	spoolDir := o.spoolDir(projectName, logPoolName)
+	if o.Options.SpoolDir != "" && spoolDir == "" {
+		service.DefaultConfig.Merge(o.KLogConfig).Logger.Errorf("klog.AsyncMultiPoolClient: invalid name for the spool directory, logs are kept in memory only, project=%s, pool=%s", projectName, logPoolName)
+	}
+	options := &AsyncClientOptions{
+		ProjectName:         projectName,
+		LogPoolName:         logPoolName,
+		Callback:            o.Options.Callback,
+		BatchCallback:       o.Options.BatchCallback,
+		DropIfPoolNotExists: o.Options.DropIfPoolNotExists,
+		QueueSize:           o.Options.QueueSize,
+		OverflowPolicy:      o.Options.OverflowPolicy,
+		OverflowTimeout:     o.Options.OverflowTimeout,
+		SpoolDir:            spoolDir,
+		SpoolMaxBytes:       o.Options.SpoolMaxBytes,
+		SpoolSegmentBytes:   o.Options.SpoolSegmentBytes,
+		SendWorkers:         o.Options.SendWorkers,
+		Ordering:            o.Options.Ordering,
+		Linger:              o.Options.Linger,
+		MaxBatchBytes:       o.Options.MaxBatchBytes,
+		MaxBatchCount:       o.Options.MaxBatchCount,
+		RetryPolicy:         o.Options.RetryPolicy,
+		MaxLogAge:           o.Options.MaxLogAge,
+		DeadLetterSink:      o.Options.DeadLetterSink,
+		OversizePolicy:      o.Options.OversizePolicy,
+		MaxBufferedBytes:    o.Options.MaxBufferedBytes,
+	}
+	if o.Options.PoolOptions != nil {
+		o.Options.PoolOptions(options)
+		options.ProjectName = projectName
+		options.LogPoolName = logPoolName
+	}
+	client := newAsyncClient(options, o.KLogConfig, o.sender, o.budget)
+	client.wake()
+	o.AsyncClients.Store(key, client)
+	return client
+}
+
+// spoolDir返回日志池的落盘目录。项目名或日志池名可能来自日志内容，
+// 不能作为目录名的名称（如空字符串）返回空字符串，该日志池不落盘。
+func (o *AsyncMultiPoolClient) spoolDir(projectName, logPoolName string) string {
+	if o.Options.SpoolDir == "" || projectName == "" || logPoolName == "" {
+		return ""
+	}
+	dir := filepath.Join(o.Options.SpoolDir, spoolDirName(projectName), spoolDirName(logPoolName))
+	// 确认目录仍在SpoolDir之下
+	if rel, err := filepath.Rel(o.Options.SpoolDir, dir); err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return dir
+}
+
+// spoolDirName把名称编码为一级目录名。url.PathEscape不转义"."，
+// "."和".."另外转义为"%2E"，以免目录跳出SpoolDir；url.PathUnescape可以还原。
+func spoolDirName(name string) string {
+	escaped := url.PathEscape(name)
+	if escaped == "." || escaped == ".." {
+		escaped = strings.Replace(escaped, ".", "%2E", -1)
+	}
+	return escaped
+}
+
+// Clients返回当前各日志池客户端的状态，按项目名和日志池名排序。
+func (o *AsyncMultiPoolClient) Clients() []PoolClientInfo {
+	var infos []PoolClientInfo
 	o.AsyncClients.Range(func(_, clientInterface interface{}) bool {
 		client, _ := clientInterface.(*AsyncClient)
-		client.Stop(false)
+		infos = append(infos, PoolClientInfo{
+			ProjectName: client.ProjectName,
+			LogPoolName: client.LogPoolName,
+			LastPushAt:  time.Unix(0, atomic.LoadInt64(&client.lastPushAt)),
+			Pending:     int(atomic.LoadInt64(&client.pending)),
+		})
 		return true
 	})
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].ProjectName != infos[j].ProjectName {
+			return infos[i].ProjectName < infos[j].ProjectName
+		}
+		return infos[i].LogPoolName < infos[j].LogPoolName
+	})
+	return infos
+}
+
+// RemovePool停止并移除日志池的客户端，语义同AsyncClient.Close()。
+// 日志池没有客户端时返回nil。之后再向该日志池推入日志时重新创建客户端。
+func (o *AsyncMultiPoolClient) RemovePool(ctx context.Context, projectName, logPoolName string) error {
+	key := poolKey(projectName, logPoolName)
+	o.mu.Lock()
+	itf, ok := o.AsyncClients.Load(key)
+	if !ok {
+		o.mu.Unlock()
+		return nil
+	}
+	client, _ := itf.(*AsyncClient)
+	o.AsyncClients.Delete(key)
+	o.removing[key] = client
+	o.mu.Unlock()
+
+	err := client.Close(ctx)
+	o.removed(key, client)
+	return err
+}
+
+func (o *AsyncMultiPoolClient) removed(key string, client *AsyncClient) {
+	o.mu.Lock()
+	if o.removing[key] == client {
+		delete(o.removing, key)
+	}
+	o.mu.Unlock()
+}
+
+// evictLoop定期停止并移除空闲的客户端。
+func (o *AsyncMultiPoolClient) evictLoop() {
+	defer close(o.evictDone)
+	ticker := time.NewTicker(o.Options.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.stopEvict:
+			return
+		case <-ticker.C:
+			o.evictIdle()
+		}
+	}
+}
+
+func (o *AsyncMultiPoolClient) evictIdle() {
+	evicted := make(map[string]*AsyncClient)
+	o.mu.Lock()
+	o.AsyncClients.Range(func(key, clientInterface interface{}) bool {
+		client, _ := clientInterface.(*AsyncClient)
+		if client.retireIfIdle(o.Options.IdleTimeout) {
+			o.AsyncClients.Delete(key)
+			o.removing[key.(string)] = client
+			evicted[key.(string)] = client
+		}
+		return true
+	})
+	o.mu.Unlock()
+
+	for key, client := range evicted {
+		// 空闲的客户端没有待处理的日志，Close很快返回
+		_ = client.Close(context.Background())
+		o.removed(key, client)
+		client.KLog.Config.Logger.Infof("INFO AsyncMultiPoolClient: idle client removed, project=%s, pool=%s", client.ProjectName, client.LogPoolName)
+	}
+}
+
+// Flush把所有日志池中已推入的日志发送出去，返回第一个遇到的错误。
+func (o *AsyncMultiPoolClient) Flush(ctx context.Context) error {
+	return o.each(func(client *AsyncClient) error {
+		return client.Flush(ctx)
+	})
+}
+
+// Close关闭所有日志池的客户端，语义同AsyncClient.Close()。
+// 之后推入的日志以ClientShutdown错误调用callback。
+func (o *AsyncMultiPoolClient) Close(ctx context.Context) error {
+	o.mu.Lock()
+	if atomic.CompareAndSwapInt32(&o.closed, 0, 1) {
+		close(o.stopEvict)
+	}
+	o.mu.Unlock()
+	<-o.evictDone
+	err := o.each(func(client *AsyncClient) error {
+		return client.Close(ctx)
+	})
+	if sErr := o.sender.close(ctx); err == nil {
+		err = sErr
+	}
+	return err
+}
+
+// Stop关闭所有日志池的客户端，最多等待DefaultStopTimeout把剩余日志发送出去。
+// 超时仍未发送的日志以ClientShutdown错误调用callback。
+func (o *AsyncMultiPoolClient) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultStopTimeout)
+	defer cancel()
+	_ = o.Close(ctx)
+}
+
+// each并发地对每个日志池的客户端执行f。
+func (o *AsyncMultiPoolClient) each(f func(*AsyncClient) error) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
 	o.AsyncClients.Range(func(_, clientInterface interface{}) bool {
 		client, _ := clientInterface.(*AsyncClient)
-		client.wg.Wait()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := f(client); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
 		return true
 	})
+	wg.Wait()
+	return firstErr
 }
@@ -0,0 +1,231 @@
+package klog
+
+import (
+	"fmt"
+	"github.com/ks3sdk/klog-go-sdk/internal/apierr"
+	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
+	"github.com/ks3sdk/klog-go-sdk/service"
+	"google.golang.org/protobuf/proto"
+	"sort"
+	"strconv"
+	"sync"
+	"unicode/utf8"
+)
+
+// OversizePolicy决定超过MaxLogSize或含有超过MaxValueSize的value的日志如何处理。
+type OversizePolicy int
+
+const (
+	// 丢弃，以MaxLogSizeExceeded或MaxValueSizeExceeded错误调用Callback。默认策略。
+	OversizeDrop OversizePolicy = iota
+	// 截断过长的value，并在末尾加上TruncatedMarker。Callback收到的是截断后的日志。
+	OversizeTruncate
+	// 拆分成多条日志发送，每条都带有ChunkIdKey、ChunkIndexKey和ChunkTotalKey字段。
+	// 全部分片处理完后，以原日志和seq no.调用一次Callback，err为第一个失败分片的错误。
+	OversizeSplit
+)
+
+// 截断的value末尾附加的标记
+const TruncatedMarker = "...[truncated]"
+
+// 分片日志附加的字段。同一条日志的分片ChunkIdKey相同，ChunkIndexKey从0开始。
+// 还原时按ChunkIndexKey排序，把各分片中同名key的value依次拼接。
+const (
+	ChunkIdKey    = "__chunk_id__"
+	ChunkIndexKey = "__chunk_index__"
+	ChunkTotalKey = "__chunk_total__"
+)
+
+const (
+	// 为分片字段、时间等预留的空间
+	chunkReserved = 1024
+	chunkBudget   = MaxLogSize - chunkReserved
+	// 每个分片最多的key数量，为分片字段预留3个
+	chunkMaxKeys = MaxKeyCount - 3
+)
+
+// splitGroup汇总一条被拆分的日志的各个分片的结果。
+type splitGroup struct {
+	mu        sync.Mutex
+	origin    *event
+	remaining int
+	err       error
+}
+
+// done记录一个分片的结果，全部分片完成时返回true。
+func (g *splitGroup) done(err error) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err != nil && g.err == nil {
+		g.err = err
+	}
+	g.remaining--
+	return g.remaining == 0
+}
+
+// isOversize判断日志是否超过MaxLogSize，或含有超过MaxValueSize的value。
+func isOversize(log *pb.Log, size int) bool {
+	if size > MaxLogSize {
+		return true
+	}
+	for _, c := range log.GetContents() {
+		if len(c.Value) > MaxValueSize {
+			return true
+		}
+	}
+	return false
+}
+
+// truncateLog返回截断过长value后的日志副本。无法截断到MaxLogSize以内时返回错误。
+func truncateLog(log *pb.Log) (*pb.Log, error) {
+	log = proto.Clone(log).(*pb.Log)
+	for _, c := range log.Contents {
+		if len(c.Value) > MaxValueSize {
+			c.Value = truncateValue(c.Value, MaxValueSize)
+		}
+	}
+
+	for size := proto.Size(log); size > MaxLogSize; size = proto.Size(log) {
+		// 每次截断最长的value
+		var longest *pb.Log_Content
+		for _, c := range log.Contents {
+			if longest == nil || len(c.Value) > len(longest.Value) {
+				longest = c
+			}
+		}
+		if longest == nil || len(longest.Value) <= len(TruncatedMarker) {
+			return nil, apierr.New(MaxLogSizeExceeded, fmt.Sprintf("the size of this log is %d after truncation and the MaxLogSize is %d", size, MaxLogSize), nil)
+		}
+		limit := len(longest.Value) - (size - MaxLogSize) - 8
+		if limit < len(TruncatedMarker) {
+			limit = len(TruncatedMarker)
+		}
+		longest.Value = truncateValue(longest.Value, limit)
+	}
+	return log, nil
+}
+
+// truncateValue把value截断到不超过limit字节，截断处位于UTF-8字符边界，末尾为TruncatedMarker。
+// value不是合法的UTF-8、找不到字符边界时按字节截断。
+func truncateValue(value string, limit int) string {
+	if len(value) <= limit {
+		return value
+	}
+	end := limit - len(TruncatedMarker)
+	if end < 0 {
+		end = 0
+	}
+	if boundary := runeBoundary(value, end); boundary > 0 {
+		end = boundary
+	}
+	return value[:end] + TruncatedMarker
+}
+
+// runeBoundary返回不大于end的最后一个UTF-8字符起始位置，找不到时返回0。
+func runeBoundary(value string, end int) int {
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return end
+}
+
+// splitLog把日志拆分成若干不超过MaxLogSize、value不超过MaxValueSize的分片。
+func splitLog(log *pb.Log) ([]*pb.Log, error) {
+	maxPiece := MaxValueSize
+	if chunkBudget/2 < maxPiece {
+		maxPiece = chunkBudget / 2
+	}
+
+	var pieces []*pb.Log_Content
+	for _, c := range log.GetContents() {
+		if len(c.Key) > MaxKeySize {
+			return nil, apierr.New(MaxKeySizeExceeded, fmt.Sprintf("the size[%d] of a key should not be greater than %d", len(c.Key), MaxKeySize), nil)
+		}
+		value := c.Value
+		for {
+			piece := value
+			if len(piece) > maxPiece {
+				// 找不到字符边界时按字节切分，否则分片为空，无法前进
+				end := runeBoundary(value, maxPiece)
+				if end == 0 {
+					end = maxPiece
+				}
+				piece = value[:end]
+			}
+			pieces = append(pieces, &pb.Log_Content{Key: c.Key, Value: piece})
+			value = value[len(piece):]
+			if len(value) == 0 {
+				break
+			}
+		}
+	}
+
+	var groups [][]*pb.Log_Content
+	var current []*pb.Log_Content
+	currentSize := 0
+	for _, piece := range pieces {
+		// 内容在pb.Log中的大小：字段标签 + 长度前缀 + 内容
+		size := proto.Size(piece) + 1 + 5
+		if size > chunkBudget {
+			return nil, apierr.New(MaxLogSizeExceeded, fmt.Sprintf("the size of a key and its value is %d and cannot be split", size), nil)
+		}
+		if len(current) > 0 && (currentSize+size > chunkBudget || len(current) >= chunkMaxKeys) {
+			groups = append(groups, current)
+			current, currentSize = nil, 0
+		}
+		current = append(current, piece)
+		currentSize += size
+	}
+	if len(current) > 0 {
+		groups = append(groups, current)
+	}
+
+	id := service.RandomString()
+	total := strconv.Itoa(len(groups))
+	chunks := make([]*pb.Log, len(groups))
+	for i, contents := range groups {
+		contents = append(contents,
+			&pb.Log_Content{Key: ChunkIdKey, Value: id},
+			&pb.Log_Content{Key: ChunkIndexKey, Value: strconv.Itoa(i)},
+			&pb.Log_Content{Key: ChunkTotalKey, Value: total},
+		)
+		chunks[i] = &pb.Log{Time: log.GetTime(), Contents: contents}
+	}
+	return chunks, nil
+}
+
+// ReassembleChunks还原OversizeSplit拆分的日志。chunks为同一ChunkIdKey的全部分片，顺序不限。
+// 相邻的同名key被视为同一个value的分段，因此原日志中相邻的同名key会被合并。
+func ReassembleChunks(chunks []*pb.Log) *pb.Log {
+	sorted := make([]*pb.Log, len(chunks))
+	copy(sorted, chunks)
+	index := func(log *pb.Log) int {
+		for _, c := range log.GetContents() {
+			if c.Key == ChunkIndexKey {
+				i, _ := strconv.Atoi(c.Value)
+				return i
+			}
+		}
+		return 0
+	}
+	sort.SliceStable(sorted, func(i, j int) bool { return index(sorted[i]) < index(sorted[j]) })
+
+	log := &pb.Log{}
+	var last *pb.Log_Content
+	for _, chunk := range sorted {
+		log.Time = chunk.GetTime()
+		for _, c := range chunk.GetContents() {
+			switch c.Key {
+			case ChunkIdKey, ChunkIndexKey, ChunkTotalKey:
+				continue
+			}
+			if last != nil && last.Key == c.Key {
+				last.Value += c.Value
+				continue
+			}
+			last = &pb.Log_Content{Key: c.Key, Value: c.Value}
+			log.Contents = append(log.Contents, last)
+		}
+	}
+	return log
+}
@@ -0,0 +1,140 @@
+package klog
+
+import (
+	"context"
+	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTruncateLog(t *testing.T) {
+	a := assert.New(t)
+	log := &pb.Log{Contents: []*pb.Log_Content{
+		{Key: "small", Value: "value"},
+		{Key: "big", Value: strings.Repeat("中", MaxValueSize)},
+		{Key: "big2", Value: strings.Repeat("x", MaxValueSize)},
+		{Key: "big3", Value: strings.Repeat("y", MaxValueSize)},
+	}}
+
+	truncated, err := truncateLog(log)
+	a.Nil(err)
+	a.Nil(CheckLog(truncated))
+	a.True(proto.Size(truncated) <= MaxLogSize)
+	a.Equal("value", truncated.Contents[0].Value)
+	a.True(strings.HasSuffix(truncated.Contents[1].Value, TruncatedMarker))
+	// 原日志不变
+	a.Equal(MaxValueSize*3, len(log.Contents[1].Value))
+}
+
+func TestSplitLog(t *testing.T) {
+	a := assert.New(t)
+	log := &pb.Log{Time: 1, Contents: []*pb.Log_Content{
+		{Key: "small", Value: "value"},
+		{Key: "big", Value: strings.Repeat("中", MaxValueSize)},
+		{Key: "tail", Value: "end"},
+	}}
+
+	chunks, err := splitLog(log)
+	a.Nil(err)
+	a.True(len(chunks) > 1)
+	for _, chunk := range chunks {
+		a.Nil(CheckLog(chunk))
+		a.True(proto.Size(chunk) <= MaxLogSize)
+	}
+
+	// 打乱顺序后还原
+	chunks[0], chunks[len(chunks)-1] = chunks[len(chunks)-1], chunks[0]
+	a.True(proto.Equal(log, ReassembleChunks(chunks)))
+}
+
+func TestAsyncClientOversizeSplit(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	recorder := newCallbackRecorder()
+
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName:    "project",
+		LogPoolName:    "pool",
+		Callback:       recorder.callback,
+		OversizePolicy: OversizeSplit,
+	}, server.config())
+	log := makeTestLog(strings.Repeat("x", MaxLogSize+1))
+	delivery := client.PushLogWithResult(log)
+	a.Nil(client.Close(context.Background()))
+
+	a.Nil(delivery.Err())
+	unique, calls := recorder.count()
+	a.Equal(1, unique)
+	a.Equal(1, calls)
+	server.mu.Lock()
+	a.True(len(server.logs) > 1)
+	a.Equal(log.Contents[0].Value, ReassembleChunks(server.logs).Contents[0].Value)
+	server.mu.Unlock()
+}
+
+func TestAsyncClientOversizeTruncate(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName:    "project",
+		LogPoolName:    "pool",
+		OversizePolicy: OversizeTruncate,
+	}, server.config())
+	delivery := client.PushLogWithResult(makeTestLog(strings.Repeat("x", MaxValueSize+1)))
+	a.Nil(client.Close(context.Background()))
+
+	a.Nil(delivery.Err())
+	a.Equal(1, server.received())
+	server.mu.Lock()
+	a.True(strings.HasSuffix(server.logs[0].Contents[0].Value, TruncatedMarker))
+	server.mu.Unlock()
+}
+
+func TestSplitLogInvalidUtf8(t *testing.T) {
+	a := assert.New(t)
+	// 没有UTF-8字符起始字节的value按字节切分
+	value := strings.Repeat("\x80", MaxValueSize+10)
+	chunks, err := splitLog(&pb.Log{Contents: []*pb.Log_Content{{Key: "big", Value: value}}})
+	a.Nil(err)
+	for _, chunk := range chunks {
+		a.True(proto.Size(chunk) <= MaxLogSize)
+		for _, c := range chunk.Contents {
+			a.True(len(c.Value) <= MaxValueSize)
+		}
+	}
+	a.Equal(value, ReassembleChunks(chunks).Contents[0].Value)
+
+	truncated := truncateValue(value, MaxValueSize)
+	a.Equal(MaxValueSize, len(truncated))
+	a.True(strings.HasSuffix(truncated, TruncatedMarker))
+}
+
+func TestAsyncClientOversizeSplitInvalidUtf8(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	recorder := newCallbackRecorder()
+
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName:    "project",
+		LogPoolName:    "pool",
+		Callback:       recorder.callback,
+		OversizePolicy: OversizeSplit,
+	}, server.config())
+	delivery := client.PushLogWithResult(makeTestLog(strings.Repeat("\x80", MaxValueSize+10)))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	a.Nil(client.Close(ctx))
+	// 分片不是合法的UTF-8，发送前被丢弃
+	a.NotNil(delivery.Err())
+	unique, calls := recorder.count()
+	a.Equal(1, unique)
+	a.Equal(1, calls)
+}
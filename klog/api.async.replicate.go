@@ -0,0 +1,307 @@
+package klog
+
+import (
+	"context"
+	"fmt"
+	"github.com/ks3sdk/klog-go-sdk/internal/apierr"
+	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
+	"github.com/ks3sdk/klog-go-sdk/service"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ReplicaCallbackPolicy决定ReplicatingClient何时调用Callback。
+type ReplicaCallbackPolicy int
+
+const (
+	// 任一目标发送成功时以nil调用一次；全部目标都失败时，以最后一个目标的错误调用。默认策略。
+	ReplicaCallbackFirst ReplicaCallbackPolicy = iota
+	// 全部目标处理完后调用一次，destination为空；任一目标失败时，err为第一个错误。
+	ReplicaCallbackAll
+	// 每个目标处理完时分别调用。
+	ReplicaCallbackEach
+)
+
+// ReplicaDestination是ReplicatingClient的一个发送目标。
+type ReplicaDestination struct {
+	// Name: 在Callback中区分目标，默认为"<ProjectName>/<LogPoolName>"
+	Name        string
+	Config      *service.Config
+	ProjectName string
+	LogPoolName string
+}
+
+type ReplicatingClientOptions struct {
+	// Destinations: 所有发送目标，至少一个
+	Destinations []ReplicaDestination
+
+	// Callback: 按CallbackPolicy调用。destination为目标的Name，其余参数同AsyncClientOptions.Callback。
+	// 可能被多个goroutine同时调用。
+	Callback       func(destination string, log *pb.Log, seqNo uint64, err error)
+	CallbackPolicy ReplicaCallbackPolicy
+
+	// 同AsyncClientOptions。QueueSize和OverflowPolicy作用于推入，其余选项对每个目标分别生效。
+	// 任一目标积压时暂停读取发送队列，此时按OverflowPolicy处理新推入的日志。
+	DropIfPoolNotExists bool
+	QueueSize           int
+	OverflowPolicy      OverflowPolicy
+	OverflowTimeout     time.Duration
+	SendWorkers         int
+	Ordering            Ordering
+	Linger              time.Duration
+	MaxBatchBytes       int
+	MaxBatchCount       int
+	RetryPolicy         RetryPolicy
+	MaxLogAge           time.Duration
+}
+
+// ReplicatingClient把同一批日志发送到多个目标，例如迁移期间同时写入两个地域或两个账号。
+// 日志只封装和序列化一次，各目标分别发送和重试，互不影响。
+type ReplicatingClient struct {
+	callback func(destination string, log *pb.Log, seqNo uint64, err error)
+	policy   ReplicaCallbackPolicy
+	names    []string
+
+	// primary负责封装，并把batch复制给replicas
+	primary  *AsyncClient
+	replicas []*AsyncClient
+	sender   *sender
+}
+
+// NewReplicatingClient新建复制发送的客户端，没有目标时返回InvalidOptions错误。
+func NewReplicatingClient(options *ReplicatingClientOptions) (*ReplicatingClient, error) {
+	if len(options.Destinations) == 0 {
+		return nil, apierr.New(InvalidOptions, "at least one destination is required", nil)
+	}
+
+	sendWorkers := 1
+	if options.SendWorkers > 0 && options.Ordering != OrderingStrict {
+		sendWorkers = options.SendWorkers
+	}
+	linger := DefaultLinger
+	if options.Linger > 0 {
+		linger = options.Linger
+	}
+
+	c := &ReplicatingClient{
+		callback: options.Callback,
+		policy:   options.CallbackPolicy,
+		sender:   newSender(sendWorkers*len(options.Destinations), lingerTick(linger), nil),
+	}
+	go c.sender.run()
+
+	var clients []*AsyncClient
+	for _, dst := range options.Destinations {
+		name := dst.Name
+		if name == "" {
+			name = fmt.Sprintf("%s/%s", dst.ProjectName, dst.LogPoolName)
+		}
+		client := newAsyncClient(&AsyncClientOptions{
+			ProjectName:         dst.ProjectName,
+			LogPoolName:         dst.LogPoolName,
+			DropIfPoolNotExists: options.DropIfPoolNotExists,
+			QueueSize:           options.QueueSize,
+			OverflowPolicy:      options.OverflowPolicy,
+			OverflowTimeout:     options.OverflowTimeout,
+			SendWorkers:         options.SendWorkers,
+			Ordering:            options.Ordering,
+			Linger:              options.Linger,
+			MaxBatchBytes:       options.MaxBatchBytes,
+			MaxBatchCount:       options.MaxBatchCount,
+			RetryPolicy:         options.RetryPolicy,
+			MaxLogAge:           options.MaxLogAge,
+		}, dst.Config, c.sender, nil)
+		client.destination = name
+		c.names = append(c.names, name)
+		clients = append(clients, client)
+	}
+	c.primary = clients[0]
+	c.replicas = clients[1:]
+	for _, r := range c.replicas {
+		r.primary = c.primary
+	}
+	c.primary.replicas = c.replicas
+	for _, client := range clients {
+		client.wake()
+	}
+	return c, nil
+}
+
+// PushLog把log推入发送队列，返回seq no.，语义同AsyncClient.PushLog()。
+func (o *ReplicatingClient) PushLog(log *pb.Log) uint64 {
+	ev := o.newEvent(log)
+	_ = o.primary.push(context.Background(), ev, o.primary.overflowPolicy)
+	return ev.seqNo
+}
+
+// PushLogWithResult同AsyncClient.PushLogWithResult()。
+// Delivery在Callback按CallbackPolicy被调用时完成；ReplicaCallbackEach时在全部目标处理完后完成，错误为第一个错误。
+func (o *ReplicatingClient) PushLogWithResult(log *pb.Log) *Delivery {
+	ev := o.newEvent(log)
+	ev.delivery = newDelivery(ev.seqNo)
+	_ = o.primary.push(context.Background(), ev, o.primary.overflowPolicy)
+	return ev.delivery
+}
+
+// TryPushLog同AsyncClient.TryPushLog()。
+func (o *ReplicatingClient) TryPushLog(log *pb.Log) (uint64, bool) {
+	ev := o.newEvent(log)
+	err := o.primary.push(context.Background(), ev, OverflowDropNewest)
+	return ev.seqNo, err == nil
+}
+
+// PushLogContext同AsyncClient.PushLogContext()。
+func (o *ReplicatingClient) PushLogContext(ctx context.Context, log *pb.Log) (uint64, error) {
+	ev := o.newEvent(log)
+	err := o.primary.push(ctx, ev, o.primary.overflowPolicy)
+	return ev.seqNo, err
+}
+
+func (o *ReplicatingClient) newEvent(log *pb.Log) *event {
+	ev := newEvent(log)
+	ev.replica = &replicaGroup{client: o, ev: ev, remaining: 1}
+	return ev
+}
+
+// Flush把已推入的日志发送到所有目标，语义同AsyncClient.Flush()。
+func (o *ReplicatingClient) Flush(ctx context.Context) error {
+	// primary先封装并复制，各目标再等待复制来的batch
+	if err := o.primary.Flush(ctx); err != nil {
+		return err
+	}
+	for _, r := range o.replicas {
+		if err := r.Flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close停止接受新的日志，把已推入的日志发送到所有目标后停止，语义同AsyncClient.Close()。
+func (o *ReplicatingClient) Close(ctx context.Context) error {
+	err := o.primary.Close(ctx)
+	for _, r := range o.replicas {
+		if rErr := r.Close(ctx); err == nil {
+			err = rErr
+		}
+	}
+	if sErr := o.sender.close(ctx); err == nil {
+		err = sErr
+	}
+	return err
+}
+
+// replicate把封装好的batch复制给各目标的客户端，各目标共用同一个请求体。
+// 在sender的goroutine中调用。
+func (o *AsyncClient) replicate(b *batch) {
+	if body, err := b.encode(); err == nil {
+		b.body = body
+	}
+	for _, ev := range b.events {
+		ev.replica.replicated(len(o.replicas))
+	}
+	for _, r := range o.replicas {
+		events := make([]*event, len(b.events))
+		for i, ev := range b.events {
+			events[i] = &event{
+				seqNo:    ev.seqNo,
+				log:      ev.log,
+				size:     ev.size,
+				pushedAt: ev.pushedAt,
+				replica:  ev.replica,
+			}
+		}
+		atomic.AddInt64(&r.pending, int64(len(events)))
+		rb := r.newBatch(events)
+		if b.body != nil {
+			rb.body = b.body.retain()
+		}
+		r.inflightMu.Lock()
+		r.inflight[rb] = struct{}{}
+		r.inflightMu.Unlock()
+		r.sealed = append(r.sealed, rb)
+	}
+}
+
+// replicasBacklogged在任一目标待发送的batch积压时返回true。
+func (o *AsyncClient) replicasBacklogged() bool {
+	for _, r := range o.replicas {
+		if len(r.sealed) >= r.sendWorkers {
+			return true
+		}
+	}
+	return false
+}
+
+// replicaGroup汇总一条日志在各目标的处理结果。
+type replicaGroup struct {
+	client *ReplicatingClient
+	ev     *event
+
+	mu sync.Mutex
+	// 尚未处理完的目标数。日志被复制之前只计primary。
+	remaining    int
+	isReplicated bool
+	reported     bool
+	firstErr     error
+}
+
+func (g *replicaGroup) replicated(n int) {
+	g.mu.Lock()
+	g.remaining += n
+	g.isReplicated = true
+	g.mu.Unlock()
+}
+
+// done记录一个目标的处理结果，并按CallbackPolicy回调。
+// 日志在被复制之前就被放弃时，视为所有目标都以err结束。
+func (g *replicaGroup) done(destination string, err error) {
+	destinations := []string{destination}
+	g.mu.Lock()
+	if !g.isReplicated {
+		destinations = g.client.names
+	}
+	g.remaining--
+	last := g.remaining == 0 || !g.isReplicated
+	if err != nil && g.firstErr == nil {
+		g.firstErr = err
+	}
+
+	var callbackErr error
+	var callback []string
+	resolve := last
+	switch g.client.policy {
+	case ReplicaCallbackFirst:
+		if !g.reported && (err == nil || last) {
+			g.reported = true
+			callback = []string{destination}
+			callbackErr = err
+			resolve = true
+		} else {
+			resolve = false
+		}
+	case ReplicaCallbackAll:
+		if last {
+			callback = []string{""}
+			callbackErr = g.firstErr
+		}
+	default:
+		callback = destinations
+		callbackErr = err
+	}
+	resolveErr := callbackErr
+	if g.client.policy == ReplicaCallbackEach {
+		resolveErr = g.firstErr
+	}
+	g.mu.Unlock()
+
+	if g.client.callback != nil {
+		for _, name := range callback {
+			g.client.callback(name, g.ev.log, g.ev.seqNo, callbackErr)
+		}
+	}
+	if resolve && g.ev.delivery != nil {
+		g.ev.delivery.resolve(resolveErr)
+	}
+}
@@ -0,0 +1,109 @@
+package klog
+
+import (
+	"context"
+	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// replicaRecorder按目标记录ReplicatingClient的回调。
+type replicaRecorder struct {
+	mu      sync.Mutex
+	results map[string][]error
+}
+
+func (r *replicaRecorder) callback(destination string, _ *pb.Log, _ uint64, err error) {
+	r.mu.Lock()
+	if r.results == nil {
+		r.results = make(map[string][]error)
+	}
+	r.results[destination] = append(r.results[destination], err)
+	r.mu.Unlock()
+}
+
+func newReplicaTestClient(t *testing.T, policy ReplicaCallbackPolicy, recorder *replicaRecorder) (*ReplicatingClient, *fakeServer, *fakeServer) {
+	a, b := newFakeServer(), newFakeServer()
+	b.setHandle(func(*pb.LogGroup, *http.Request) (int, string) {
+		return http.StatusNotFound, ProjectOrLogPoolNotExist
+	})
+	client, err := NewReplicatingClient(&ReplicatingClientOptions{
+		Destinations: []ReplicaDestination{
+			{Name: "a", Config: a.config(), ProjectName: "project", LogPoolName: "pool"},
+			{Name: "b", Config: b.config(), ProjectName: "project", LogPoolName: "pool"},
+		},
+		Callback:            recorder.callback,
+		CallbackPolicy:      policy,
+		DropIfPoolNotExists: true,
+		Linger:              10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, a, b
+}
+
+func TestReplicatingClientFirst(t *testing.T) {
+	a := assert.New(t)
+	recorder := &replicaRecorder{}
+	client, serverA, serverB := newReplicaTestClient(t, ReplicaCallbackFirst, recorder)
+	defer serverA.Close()
+	defer serverB.Close()
+
+	var deliveries []*Delivery
+	for i := 0; i < 10; i++ {
+		deliveries = append(deliveries, client.PushLogWithResult(makeTestLog("value")))
+	}
+	a.Nil(client.Close(context.Background()))
+
+	a.Equal(10, serverA.received())
+	a.Len(recorder.results["a"], 10)
+	a.Empty(recorder.results["b"])
+	for _, d := range deliveries {
+		a.Equal(DeliverySent, d.Outcome())
+	}
+}
+
+func TestReplicatingClientAll(t *testing.T) {
+	a := assert.New(t)
+	recorder := &replicaRecorder{}
+	client, serverA, serverB := newReplicaTestClient(t, ReplicaCallbackAll, recorder)
+	defer serverA.Close()
+	defer serverB.Close()
+
+	delivery := client.PushLogWithResult(makeTestLog("value"))
+	a.Nil(client.Flush(context.Background()))
+	a.Equal(DeliveryDroppedPoolMissing, delivery.Outcome())
+	a.Nil(client.Close(context.Background()))
+
+	a.Equal(1, serverA.received())
+	a.Len(recorder.results[""], 1)
+	a.True(IsError(recorder.results[""][0], ProjectOrLogPoolNotExist))
+}
+
+func TestReplicatingClientEach(t *testing.T) {
+	a := assert.New(t)
+	recorder := &replicaRecorder{}
+	client, serverA, serverB := newReplicaTestClient(t, ReplicaCallbackEach, recorder)
+	defer serverA.Close()
+	defer serverB.Close()
+
+	for i := 0; i < 5; i++ {
+		client.PushLog(makeTestLog("value"))
+	}
+	a.Nil(client.Close(context.Background()))
+
+	a.Equal([]error{nil, nil, nil, nil, nil}, recorder.results["a"])
+	a.Len(recorder.results["b"], 5)
+	for _, err := range recorder.results["b"] {
+		a.True(IsError(err, ProjectOrLogPoolNotExist))
+	}
+
+	// 关闭后推入的日志对每个目标都回调
+	client.PushLog(makeTestLog("value"))
+	a.True(IsError(recorder.results["a"][5], ClientShutdown))
+	a.True(IsError(recorder.results["b"][5], ClientShutdown))
+}
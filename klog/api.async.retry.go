@@ -0,0 +1,81 @@
+package klog
+
+import (
+	"github.com/ks3sdk/klog-go-sdk/service"
+	"time"
+)
+
+// RetryPolicy决定AsyncClient发送失败后是否重试，以及重试之前等待多久。
+// 同一个RetryPolicy可能被多个发送线程同时使用。
+type RetryPolicy interface {
+	// NextDelay返回第attempt次发送失败后（attempt从1开始）的等待时间。
+	// elapsed为从第一次发送到现在经过的时间，err为最后一次发送的错误。
+	// 返回false表示放弃重试，batch中的日志以RetryExhausted错误调用Callback。
+	NextDelay(attempt int, elapsed time.Duration, err error) (time.Duration, bool)
+}
+
+const (
+	DefaultRetryBaseDelay = time.Second
+	DefaultRetryMaxDelay  = 120 * time.Second
+)
+
+// ExponentialRetryPolicy是带全抖动(full jitter)的指数退避：
+// 第n次失败后等待[0, min(MaxDelay, BaseDelay * 2^(n-1))]之间的随机时间。
+type ExponentialRetryPolicy struct {
+	// 默认为DefaultRetryBaseDelay
+	BaseDelay time.Duration
+	// 默认为DefaultRetryMaxDelay
+	MaxDelay time.Duration
+	// 最多发送的次数，0表示不限制
+	MaxAttempts int
+	// 从第一次发送起，最多重试的时间，0表示不限制
+	MaxElapsed time.Duration
+}
+
+func (p *ExponentialRetryPolicy) NextDelay(attempt int, elapsed time.Duration, err error) (time.Duration, bool) {
+	if exhausted(attempt, elapsed, p.MaxAttempts, p.MaxElapsed) {
+		return 0, false
+	}
+
+	base := p.BaseDelay
+	if base <= 0 {
+		base = DefaultRetryBaseDelay
+	}
+	max := p.MaxDelay
+	if max <= 0 {
+		max = DefaultRetryMaxDelay
+	}
+	ceiling := max
+	if attempt >= 1 && attempt < 32 && base <= max>>uint(attempt-1) {
+		ceiling = base << uint(attempt-1)
+	}
+	// 按int64取随机数，32位平台上超过约2.1秒的纳秒数会使int溢出
+	return time.Duration(service.MakeRandomInt64(int64(ceiling) + 1)), true
+}
+
+// FixedRetryPolicy每次失败后等待固定的时间。
+type FixedRetryPolicy struct {
+	Delay time.Duration
+	// 最多发送的次数，0表示不限制
+	MaxAttempts int
+	// 从第一次发送起，最多重试的时间，0表示不限制
+	MaxElapsed time.Duration
+}
+
+func (p *FixedRetryPolicy) NextDelay(attempt int, elapsed time.Duration, err error) (time.Duration, bool) {
+	if exhausted(attempt, elapsed, p.MaxAttempts, p.MaxElapsed) {
+		return 0, false
+	}
+	return p.Delay, true
+}
+
+func exhausted(attempt int, elapsed time.Duration, maxAttempts int, maxElapsed time.Duration) bool {
+	return (maxAttempts > 0 && attempt >= maxAttempts) || (maxElapsed > 0 && elapsed >= maxElapsed)
+}
+
+// defaultRetryPolicy是未设置RetryPolicy时的行为：随机退避，最长120秒，永不放弃。
+type defaultRetryPolicy struct{}
+
+func (p defaultRetryPolicy) NextDelay(attempt int, elapsed time.Duration, err error) (time.Duration, bool) {
+	return service.MakeRandomDelay(attempt), true
+}
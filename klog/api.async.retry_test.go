@@ -0,0 +1,110 @@
+package klog
+
+import (
+	"context"
+	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestExponentialRetryPolicy(t *testing.T) {
+	a := assert.New(t)
+	p := &ExponentialRetryPolicy{BaseDelay: 10 * time.Millisecond, MaxDelay: 50 * time.Millisecond, MaxAttempts: 5}
+	for attempt := 1; attempt < 5; attempt++ {
+		delay, ok := p.NextDelay(attempt, 0, nil)
+		a.True(ok)
+		a.True(delay >= 0)
+		a.True(delay <= 50*time.Millisecond)
+		if attempt == 1 {
+			a.True(delay <= 10*time.Millisecond)
+		}
+	}
+	_, ok := p.NextDelay(5, 0, nil)
+	a.False(ok)
+
+	p = &ExponentialRetryPolicy{MaxElapsed: time.Second}
+	_, ok = p.NextDelay(100, time.Second, nil)
+	a.False(ok)
+	delay, ok := p.NextDelay(100, 0, nil)
+	a.True(ok)
+	a.True(delay <= DefaultRetryMaxDelay)
+}
+
+func TestExponentialRetryPolicyLargeAttempts(t *testing.T) {
+	a := assert.New(t)
+	policies := []*ExponentialRetryPolicy{
+		{},
+		{BaseDelay: 10 * time.Second, MaxDelay: time.Hour},
+	}
+	for _, p := range policies {
+		max := p.MaxDelay
+		if max == 0 {
+			max = DefaultRetryMaxDelay
+		}
+		for attempt := 1; attempt <= 40; attempt++ {
+			delay, ok := p.NextDelay(attempt, 0, nil)
+			a.True(ok)
+			a.True(delay >= 0 && delay <= max, "attempt %d: %s", attempt, delay)
+		}
+	}
+}
+
+func TestFixedRetryPolicy(t *testing.T) {
+	a := assert.New(t)
+	p := &FixedRetryPolicy{Delay: time.Second, MaxAttempts: 2}
+	delay, ok := p.NextDelay(1, 0, nil)
+	a.True(ok)
+	a.Equal(time.Second, delay)
+	_, ok = p.NextDelay(2, 0, nil)
+	a.False(ok)
+}
+
+func TestAsyncClientRetryExhausted(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	server.setHandle(func(*pb.LogGroup, *http.Request) (int, string) {
+		return http.StatusForbidden, SignatureNotMatch
+	})
+	recorder := newCallbackRecorder()
+
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName: "project",
+		LogPoolName: "pool",
+		Callback:    recorder.callback,
+		RetryPolicy: &FixedRetryPolicy{Delay: time.Millisecond, MaxAttempts: 3},
+	}, server.config())
+	client.PushLog(makeTestLog("value"))
+	a.Nil(client.Close(context.Background()))
+
+	a.Equal(1, recorder.errorCount(RetryExhausted))
+	server.mu.Lock()
+	a.Equal(3, server.requests)
+	server.mu.Unlock()
+}
+
+func TestAsyncClientMaxLogAge(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	server.setHandle(func(*pb.LogGroup, *http.Request) (int, string) {
+		return http.StatusInternalServerError, InternalServerError
+	})
+	recorder := newCallbackRecorder()
+
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName: "project",
+		LogPoolName: "pool",
+		Callback:    recorder.callback,
+		RetryPolicy: &FixedRetryPolicy{Delay: 20 * time.Millisecond},
+		MaxLogAge:   100 * time.Millisecond,
+	}, server.config())
+	client.PushLog(makeTestLog("value"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	a.Nil(client.Close(ctx))
+
+	a.Equal(1, recorder.errorCount(MaxLogAgeExceeded))
+}
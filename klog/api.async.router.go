@@ -0,0 +1,263 @@
+package klog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ks3sdk/klog-go-sdk/internal/apierr"
+	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
+	"io/ioutil"
+	"regexp"
+)
+
+// RouteCondition的匹配方式
+const (
+	// Key的value等于Value
+	RouteOpEquals = "equals"
+	// Key的value匹配正则表达式Value
+	RouteOpRegex = "regex"
+	// 日志中存在Key
+	RouteOpExists = "exists"
+)
+
+// RouteCondition是路由规则中的一个条件。
+type RouteCondition struct {
+	Key string `json:"key"`
+	// RouteOpEquals, RouteOpRegex或RouteOpExists，默认为RouteOpEquals
+	Op    string `json:"op,omitempty"`
+	Value string `json:"value,omitempty"`
+}
+
+// RouteTarget是日志的目标项目和日志池。
+// 名称中的"{key}"被替换为日志中key的value，例如"app-{env}"。日志中没有该key时，该目标不可用。
+type RouteTarget struct {
+	ProjectName string `json:"project"`
+	LogPoolName string `json:"pool"`
+}
+
+// RouteRule在日志满足全部Match条件时，把日志发往RouteTarget。Match为空时总是满足。
+type RouteRule struct {
+	Name  string           `json:"name,omitempty"`
+	Match []RouteCondition `json:"match,omitempty"`
+	RouteTarget
+}
+
+// RouterConfig是RouterClient的路由配置，可用LoadRouterConfig从JSON文件读取，例如：
+//
+//	{
+//	  "rules": [
+//	    {"match": [{"key": "level", "value": "error"}], "project": "app", "pool": "errors"},
+//	    {"match": [{"key": "env", "op": "exists"}], "project": "app", "pool": "app-{env}"}
+//	  ],
+//	  "default": {"project": "app", "pool": "others"}
+//	}
+type RouterConfig struct {
+	// 按顺序匹配，使用第一条满足且目标可用的规则
+	Rules []RouteRule `json:"rules"`
+	// 没有规则可用时的目标，为空时这类日志以NoRoute错误调用Callback
+	Default *RouteTarget `json:"default,omitempty"`
+}
+
+// LoadRouterConfig从JSON文件读取路由配置。
+func LoadRouterConfig(path string) (*RouterConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &RouterConfig{}
+	if err = json.Unmarshal(data, config); err != nil {
+		return nil, apierr.New(InvalidOptions, fmt.Sprintf("failed to parse router config %s", path), err)
+	}
+	return config, nil
+}
+
+// RouterClient按日志内容选择项目和日志池，通过AsyncMultiPoolClient发送。
+type RouterClient struct {
+	Client *AsyncMultiPoolClient
+
+	rules      []*routeRule
+	defaultDst *routeTarget
+}
+
+type routeRule struct {
+	conditions []routeCondition
+	target     *routeTarget
+}
+
+type routeCondition struct {
+	key    string
+	op     string
+	value  string
+	regexp *regexp.Regexp
+}
+
+type routeTarget struct {
+	projectName string
+	logPoolName string
+	// 名称中含有模板时为true
+	templated bool
+}
+
+var routeTemplate = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// NewRouterClient按config新建RouterClient，config不合法时返回InvalidOptions错误。
+// client的关闭由调用方负责，也可以调用RouterClient.Close()。
+func NewRouterClient(config *RouterConfig, client *AsyncMultiPoolClient) (*RouterClient, error) {
+	r := &RouterClient{Client: client}
+	for i, rule := range config.Rules {
+		compiled := &routeRule{}
+		for _, cond := range rule.Match {
+			c := routeCondition{key: cond.Key, op: cond.Op, value: cond.Value}
+			switch cond.Op {
+			case "", RouteOpEquals:
+				c.op = RouteOpEquals
+			case RouteOpRegex:
+				re, err := regexp.Compile(cond.Value)
+				if err != nil {
+					return nil, apierr.New(InvalidOptions, fmt.Sprintf("rule[%d] has an invalid regex %q", i, cond.Value), err)
+				}
+				c.regexp = re
+			case RouteOpExists:
+			default:
+				return nil, apierr.New(InvalidOptions, fmt.Sprintf("rule[%d] has an unknown op %q", i, cond.Op), nil)
+			}
+			compiled.conditions = append(compiled.conditions, c)
+		}
+		target, err := newRouteTarget(rule.RouteTarget)
+		if err != nil {
+			return nil, apierr.New(InvalidOptions, fmt.Sprintf("rule[%d] has an invalid target", i), err)
+		}
+		compiled.target = target
+		r.rules = append(r.rules, compiled)
+	}
+	if config.Default != nil {
+		target, err := newRouteTarget(*config.Default)
+		if err != nil {
+			return nil, apierr.New(InvalidOptions, "the default route is invalid", err)
+		}
+		r.defaultDst = target
+	}
+	return r, nil
+}
+
+func newRouteTarget(target RouteTarget) (*routeTarget, error) {
+	if target.ProjectName == "" || target.LogPoolName == "" {
+		return nil, apierr.New(InvalidOptions, "project and pool should not be empty", nil)
+	}
+	return &routeTarget{
+		projectName: target.ProjectName,
+		logPoolName: target.LogPoolName,
+		templated:   routeTemplate.MatchString(target.ProjectName) || routeTemplate.MatchString(target.LogPoolName),
+	}, nil
+}
+
+// Route返回log的目标项目和日志池。没有可用的规则和默认目标时返回NoRoute错误。
+func (r *RouterClient) Route(log *pb.Log) (string, string, error) {
+	values := make(map[string]string, len(log.Contents))
+	for _, content := range log.Contents {
+		values[content.Key] = content.Value
+	}
+
+	for _, rule := range r.rules {
+		if !rule.match(values) {
+			continue
+		}
+		if projectName, logPoolName, ok := rule.target.expand(values); ok {
+			return projectName, logPoolName, nil
+		}
+	}
+	if r.defaultDst != nil {
+		if projectName, logPoolName, ok := r.defaultDst.expand(values); ok {
+			return projectName, logPoolName, nil
+		}
+	}
+	return "", "", apierr.New(NoRoute, "no route matches the log", nil)
+}
+
+func (r *routeRule) match(values map[string]string) bool {
+	for _, c := range r.conditions {
+		value, ok := values[c.key]
+		if !ok {
+			return false
+		}
+		switch c.op {
+		case RouteOpEquals:
+			if value != c.value {
+				return false
+			}
+		case RouteOpRegex:
+			if !c.regexp.MatchString(value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// expand替换名称中的模板，日志中缺少模板引用的key时返回false。
+func (t *routeTarget) expand(values map[string]string) (string, string, bool) {
+	if !t.templated {
+		return t.projectName, t.logPoolName, true
+	}
+	ok := true
+	replace := func(s string) string {
+		return routeTemplate.ReplaceAllStringFunc(s, func(m string) string {
+			value, found := values[m[1:len(m)-1]]
+			if !found || value == "" {
+				ok = false
+			}
+			return value
+		})
+	}
+	projectName, logPoolName := replace(t.projectName), replace(t.logPoolName)
+	return projectName, logPoolName, ok
+}
+
+// PushLog按路由推入log，语义同AsyncMultiPoolClient.PushLog()。
+// 没有可用的路由时，以NoRoute错误调用callback。
+func (r *RouterClient) PushLog(log *pb.Log) uint64 {
+	ev := newEvent(log)
+	_ = r.push(context.Background(), ev, false)
+	return ev.seqNo
+}
+
+// PushLogWithResult同AsyncMultiPoolClient.PushLogWithResult()。
+func (r *RouterClient) PushLogWithResult(log *pb.Log) *Delivery {
+	ev := newEvent(log)
+	ev.delivery = newDelivery(ev.seqNo)
+	_ = r.push(context.Background(), ev, false)
+	return ev.delivery
+}
+
+// TryPushLog同AsyncMultiPoolClient.TryPushLog()。
+func (r *RouterClient) TryPushLog(log *pb.Log) (uint64, bool) {
+	ev := newEvent(log)
+	err := r.push(context.Background(), ev, true)
+	return ev.seqNo, err == nil
+}
+
+// PushLogContext同AsyncMultiPoolClient.PushLogContext()。
+func (r *RouterClient) PushLogContext(ctx context.Context, log *pb.Log) (uint64, error) {
+	ev := newEvent(log)
+	err := r.push(ctx, ev, false)
+	return ev.seqNo, err
+}
+
+func (r *RouterClient) push(ctx context.Context, ev *event, noWait bool) error {
+	projectName, logPoolName, err := r.Route(ev.log)
+	if err != nil {
+		r.Client.report(ev, err)
+		return err
+	}
+	return r.Client.push(ctx, projectName, logPoolName, ev, noWait)
+}
+
+// Flush同AsyncMultiPoolClient.Flush()。
+func (r *RouterClient) Flush(ctx context.Context) error {
+	return r.Client.Flush(ctx)
+}
+
+// Close同AsyncMultiPoolClient.Close()。
+func (r *RouterClient) Close(ctx context.Context) error {
+	return r.Client.Close(ctx)
+}
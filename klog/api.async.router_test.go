@@ -0,0 +1,104 @@
+package klog
+
+import (
+	"context"
+	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+const testRouterConfig = `{
+  "rules": [
+    {"name": "errors", "match": [{"key": "level", "value": "error"}], "project": "app", "pool": "errors"},
+    {"match": [{"key": "msg", "op": "regex", "value": "^audit:"}], "project": "sec", "pool": "audit"},
+    {"match": [{"key": "env", "op": "exists"}], "project": "app", "pool": "app-{env}"}
+  ],
+  "default": {"project": "app", "pool": "others"}
+}`
+
+func routerTestLog(kv ...string) *pb.Log {
+	log := &pb.Log{}
+	for i := 0; i+1 < len(kv); i += 2 {
+		log.Contents = append(log.Contents, &pb.Log_Content{Key: kv[i], Value: kv[i+1]})
+	}
+	return log
+}
+
+func TestRouterClientRoute(t *testing.T) {
+	a := assert.New(t)
+	dir, err := ioutil.TempDir("", "klog-router")
+	a.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "router.json")
+	a.Nil(ioutil.WriteFile(path, []byte(testRouterConfig), 0644))
+
+	config, err := LoadRouterConfig(path)
+	a.Nil(err)
+	router, err := NewRouterClient(config, nil)
+	a.Nil(err)
+
+	cases := []struct {
+		log     *pb.Log
+		project string
+		pool    string
+	}{
+		{routerTestLog("level", "error", "env", "prod"), "app", "errors"},
+		{routerTestLog("msg", "audit: login"), "sec", "audit"},
+		{routerTestLog("env", "prod"), "app", "app-prod"},
+		// 模板引用的key为空时，该规则不可用
+		{routerTestLog("env", ""), "app", "others"},
+		{routerTestLog("level", "info"), "app", "others"},
+	}
+	for _, c := range cases {
+		project, pool, err := router.Route(c.log)
+		a.Nil(err)
+		a.Equal(c.project, project)
+		a.Equal(c.pool, pool)
+	}
+
+	config.Default = nil
+	router, err = NewRouterClient(config, nil)
+	a.Nil(err)
+	_, _, err = router.Route(routerTestLog("level", "info"))
+	a.True(IsError(err, NoRoute))
+
+	_, err = NewRouterClient(&RouterConfig{Rules: []RouteRule{{
+		Match:       []RouteCondition{{Key: "msg", Op: RouteOpRegex, Value: "("}},
+		RouteTarget: RouteTarget{ProjectName: "app", LogPoolName: "pool"},
+	}}}, nil)
+	a.True(IsError(err, InvalidOptions))
+}
+
+func TestRouterClientPushLog(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	var mu sync.Mutex
+	pools := make(map[string]int)
+	server.setHandle(func(lg *pb.LogGroup, r *http.Request) (int, string) {
+		mu.Lock()
+		pools[r.URL.Query().Get("LogPoolName")] += len(lg.Logs)
+		mu.Unlock()
+		return 0, ""
+	})
+
+	router, err := NewRouterClient(&RouterConfig{Rules: []RouteRule{{
+		Match:       []RouteCondition{{Key: "env", Op: RouteOpExists}},
+		RouteTarget: RouteTarget{ProjectName: "app", LogPoolName: "app-{env}"},
+	}}}, NewAsyncMultiPoolClient(&AsyncMultiPoolClientOptions{}, server.config()))
+	a.Nil(err)
+
+	router.PushLog(routerTestLog("env", "prod"))
+	router.PushLog(routerTestLog("env", "test"))
+	router.PushLog(routerTestLog("env", "prod"))
+	delivery := router.PushLogWithResult(routerTestLog("level", "info"))
+	a.True(IsError(delivery.Err(), NoRoute))
+	a.Nil(router.Close(context.Background()))
+
+	a.Equal(map[string]int{"app-prod": 2, "app-test": 1}, pools)
+}
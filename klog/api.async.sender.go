@@ -0,0 +1,372 @@
+package klog
+
+import (
+	"context"
+	"github.com/ks3sdk/klog-go-sdk/service"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sender把一个或多个AsyncClient推入的日志封装成batch，交给固定数量的发送线程发送。
+// AsyncClient单独使用时拥有自己的sender；AsyncMultiPoolClient的所有日志池共用一个sender。
+// 有batch待发送的日志池轮流使用发送线程，每个日志池同时发送的batch数不超过其SendWorkers，
+// 等待重试的batch不占用发送线程，因此一个持续失败的日志池不会影响其他日志池。
+// 客户端的buf、sealed等封装状态只在sender的goroutine中访问。
+type sender struct {
+	workers int
+	// tick是检查linger的间隔，按已加入的客户端中最短的linger缩短
+	tick time.Duration
+	// owner非nil时，sender只服务于这一个客户端，客户端停止后sender随之停止
+	owner *AsyncClient
+
+	// notified记录有新日志的客户端，notify在其非空时有信号。
+	// 通知不阻塞，回调和sender自身调用PushLog时不会死锁。
+	notifyMu sync.Mutex
+	notified []*AsyncClient
+	notify   chan struct{}
+
+	flushCh chan *flushRequest
+	abortCh chan *AsyncClient
+	batchCh chan *batch
+	doneCh  chan *batch
+	retryCh chan *batch
+	quit    chan struct{}
+	done    chan struct{}
+
+	quitOnce sync.Once
+
+	clients  map[*AsyncClient]struct{}
+	ready    []*AsyncClient
+	stopping bool
+}
+
+// attempt的结果
+type attemptResult int
+
+const (
+	// batch已处理完
+	attemptDone attemptResult = iota
+	// 等待batch.delay后重试
+	attemptRetry
+	// 拆分成batch.halves分别发送
+	attemptSplit
+)
+
+func newSender(workers int, tick time.Duration, owner *AsyncClient) *sender {
+	return &sender{
+		workers: workers,
+		tick:    tick,
+		owner:   owner,
+		notify:  make(chan struct{}, 1),
+		flushCh: make(chan *flushRequest),
+		abortCh: make(chan *AsyncClient),
+		batchCh: make(chan *batch),
+		doneCh:  make(chan *batch),
+		retryCh: make(chan *batch),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		clients: make(map[*AsyncClient]struct{}),
+	}
+}
+
+// close在所有客户端停止后停止sender，ctx结束时不再等待并返回ctx.Err()。只用于共用的sender。
+func (s *sender) close(ctx context.Context) error {
+	s.quitOnce.Do(func() {
+		close(s.quit)
+	})
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// run负责把日志封装成batch，按顺序交给发送线程，并处理发送的结果。
+func (s *sender) run() {
+	defer close(s.done)
+
+	workers := new(sync.WaitGroup)
+	for i := 0; i < s.workers; i++ {
+		workers.Add(1)
+		go s.work(workers)
+	}
+	defer func() {
+		close(s.batchCh)
+		workers.Wait()
+	}()
+
+	tick := s.tick
+	ticker := time.NewTicker(tick)
+	defer func() {
+		ticker.Stop()
+	}()
+
+	quit := s.quit
+	for {
+		if s.stopping && len(s.clients) == 0 {
+			return
+		}
+		if s.tick != tick {
+			ticker.Stop()
+			tick = s.tick
+			ticker = time.NewTicker(tick)
+		}
+		var out chan *batch
+		var next *batch
+		c := s.next()
+		if c != nil {
+			out = s.batchCh
+			next = c.sealed[0]
+		}
+
+		select {
+		case <-s.notify:
+			s.notifyMu.Lock()
+			notified := s.notified
+			s.notified = nil
+			s.notifyMu.Unlock()
+			for _, c := range notified {
+				atomic.StoreInt32(&c.notified, 0)
+				s.attach(c)
+				s.resume(c)
+				s.refresh(c)
+			}
+		case req := <-s.flushCh:
+			c := req.client
+			s.attach(c)
+			c.drain()
+			c.seal()
+			req.done <- c.newFlushWaiter()
+			if req.final {
+				// 收到Close的请求后不再读取ch，剩余的batch处理完后停止
+				c.draining = true
+			}
+			s.refresh(c)
+		case out <- next:
+			c.sealed[0] = nil
+			c.sealed = c.sealed[1:]
+			c.sending++
+			c.queued = false
+			s.ready[0] = nil
+			s.ready = s.ready[1:]
+			s.refresh(c)
+		case b := <-s.doneCh:
+			s.finished(b)
+		case b := <-s.retryCh:
+			s.retried(b)
+		case c := <-s.abortCh:
+			s.attach(c)
+			s.abort(c)
+		case <-ticker.C:
+			now := time.Now()
+			for c := range s.clients {
+				if len(c.buf) > 0 && now.Sub(c.lastSendAt) > c.linger {
+					c.seal()
+					s.refresh(c)
+				}
+			}
+		case <-quit:
+			s.stopping = true
+			quit = nil
+		}
+	}
+}
+
+// wake通知run处理客户端c，不阻塞。
+func (s *sender) wake(c *AsyncClient) {
+	s.notifyMu.Lock()
+	s.notified = append(s.notified, c)
+	s.notifyMu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// work是发送线程，每次发送一个batch，把结果交回run处理。
+func (s *sender) work(wg *sync.WaitGroup) {
+	defer wg.Done()
+	for b := range s.batchCh {
+		b.next = b.client.attempt(b)
+		s.doneCh <- b
+	}
+}
+
+// attach开始处理客户端，先处理上次未发送完的日志。
+func (s *sender) attach(c *AsyncClient) {
+	if c.attached || c.detached {
+		return
+	}
+	c.attached = true
+	s.clients[c] = struct{}{}
+	if tick := lingerTick(c.linger); tick < s.tick {
+		s.tick = tick
+	}
+	if breaker := c.KLog.Config.CircuitBreaker; breaker != nil {
+		// 熔断器不再打开时唤醒客户端，恢复暂停的重试
+		c.stopWatch = breaker.OnStateChange(func(from, to service.CircuitState) {
+			if to != service.CircuitOpen {
+				c.wake()
+			}
+		})
+	}
+	for _, l := range c.replay {
+		ev := newEvent(l.log)
+		ev.segment = l.segment
+		c.add(ev)
+	}
+	c.replay = nil
+}
+
+// refresh在客户端的状态变化后，继续读取其发送队列，安排发送，并在其日志全部处理完后停止它。
+// 复制发送时，同时安排各目标的客户端；目标的积压减少时，负责封装的客户端继续读取发送队列。
+func (s *sender) refresh(c *AsyncClient) {
+	if c.detached {
+		return
+	}
+	if !c.draining && !c.aborted {
+		c.fill()
+	}
+	s.schedule(c)
+	for _, r := range c.replicas {
+		s.schedule(r)
+	}
+	if c.primary != nil {
+		s.refresh(c.primary)
+	}
+}
+
+// schedule把有batch可发送的客户端排入轮转队列，并在其日志全部处理完后停止它。
+func (s *sender) schedule(c *AsyncClient) {
+	if c.detached {
+		return
+	}
+	if !c.queued && len(c.sealed) > 0 && c.sending < c.sendWorkers {
+		c.queued = true
+		s.ready = append(s.ready, c)
+	}
+	if c.sending == 0 && (c.aborted || c.draining && len(c.sealed) == 0) {
+		s.detach(c)
+	}
+}
+
+// next返回轮到发送的客户端，没有可发送的batch时返回nil。
+func (s *sender) next() *AsyncClient {
+	for len(s.ready) > 0 {
+		c := s.ready[0]
+		if !c.detached && len(c.sealed) > 0 && c.sending < c.sendWorkers {
+			return c
+		}
+		c.queued = false
+		s.ready[0] = nil
+		s.ready = s.ready[1:]
+	}
+	return nil
+}
+
+// finished处理发送线程交回的batch。
+func (s *sender) finished(b *batch) {
+	c := b.client
+	c.sending--
+	switch b.next {
+	case attemptRetry:
+		if c.aborted {
+			c.complete(b, errShutdown(b.err))
+			c.batchDone(b)
+			break
+		}
+		c.sending++
+		c.retrying[b] = struct{}{}
+		b.timer = time.AfterFunc(b.delay, func() {
+			select {
+			case s.retryCh <- b:
+			case <-s.done:
+			}
+		})
+	case attemptSplit:
+		halves := b.halves
+		b.halves = nil
+		if c.aborted {
+			for _, half := range halves {
+				c.complete(half, errShutdown(b.err))
+			}
+			c.batchDone(b)
+			break
+		}
+		c.replaceBatch(b, halves)
+		c.sealed = append(halves, c.sealed...)
+	default:
+		c.batchDone(b)
+	}
+	s.refresh(c)
+}
+
+// retried把等待重试结束的batch放回待发送队列的最前面。
+func (s *sender) retried(b *batch) {
+	c := b.client
+	if _, ok := c.retrying[b]; !ok {
+		// 客户端已停止，batch已回调
+		return
+	}
+	delete(c.retrying, b)
+	b.paused = false
+	c.sending--
+	c.sealed = append([]*batch{b}, c.sealed...)
+	s.refresh(c)
+}
+
+// resume在熔断器不再打开时，立即重试因熔断而暂停的batch。
+func (s *sender) resume(c *AsyncClient) {
+	breaker := c.KLog.Config.CircuitBreaker
+	if breaker == nil || breaker.State() == service.CircuitOpen {
+		return
+	}
+	for b := range c.retrying {
+		// 计时器已触发的batch由retryCh处理
+		if b.paused && b.timer.Stop() {
+			s.retried(b)
+		}
+	}
+}
+
+// abort放弃客户端所有尚未发送成功的日志，正在发送的batch在发送线程交回后放弃。
+func (s *sender) abort(c *AsyncClient) {
+	if c.detached || c.aborted {
+		return
+	}
+	c.aborted = true
+	c.abandon(nil)
+	for b := range c.retrying {
+		// 收到停止信号
+		c.KLog.Config.Logger.Infof("INFO AsyncClient.Send: cancel received, stop retry, project=%s, pool=%s", c.ProjectName, c.LogPoolName)
+		b.timer.Stop()
+		c.complete(b, errShutdown(b.err))
+		c.batchDone(b)
+		c.sending--
+	}
+	c.retrying = nil
+	s.refresh(c)
+}
+
+// detach在客户端的日志全部处理完后停止客户端。
+func (s *sender) detach(c *AsyncClient) {
+	c.detached = true
+	delete(s.clients, c)
+	if c.stopWatch != nil {
+		c.stopWatch()
+	}
+	close(c.runDone)
+	// 等排在前面的回调执行完，再关闭落盘文件并结束客户端
+	c.callbacks.push(func() {
+		if c.spool != nil {
+			c.spool.close()
+		}
+		close(c.stopped)
+		c.wg.Done()
+	})
+	if s.owner == c {
+		s.stopping = true
+	}
+}
@@ -0,0 +1,266 @@
+package klog
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/ks3sdk/klog-go-sdk/internal/apierr"
+	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
+	"github.com/ks3sdk/klog-go-sdk/service"
+	"google.golang.org/protobuf/proto"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	DefaultSpoolMaxBytes     = 1 << 30  // byte
+	DefaultSpoolSegmentBytes = 64 << 20 // byte
+
+	spoolSegmentExt    = ".seg"
+	spoolRecordHeader  = 8 // 4字节长度 + 4字节CRC32
+	spoolMaxRecordSize = MaxLogSize * 2
+)
+
+var spoolCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// spool是AsyncClient的落盘预写日志。
+//
+// 日志在进入发送队列之前追加到当前的segment文件中，记录格式为：
+// 4字节大端长度 + 4字节CRC32C + 序列化后的pb.Log。
+// 一个segment中的日志全部确认（发送成功或被明确丢弃）后，
+// segment文件被删除；如果是正在写入的segment，则被截断为空。
+// 进程重启后，NewAsyncClient读取目录中剩余的segment并重新发送。
+type spool struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	logger       service.Logger
+
+	mu         sync.Mutex
+	active     *segment
+	segments   map[uint64]*segment
+	nextID     uint64
+	totalBytes int64
+}
+
+type segment struct {
+	id      uint64
+	path    string
+	file    *os.File
+	size    int64
+	pending int
+}
+
+// spooledLog是从segment中恢复出来的一条日志。
+type spooledLog struct {
+	log     *pb.Log
+	segment *segment
+}
+
+// openSpool打开dir中的spool，返回其中尚未确认的日志。
+// 损坏的记录及其之后的内容被丢弃，并记录错误日志。
+func openSpool(dir string, maxBytes, segmentBytes int64, logger service.Logger) (*spool, []*spooledLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, nil, err
+	}
+	s := &spool{
+		dir:          dir,
+		maxBytes:     maxBytes,
+		segmentBytes: segmentBytes,
+		logger:       logger,
+		segments:     make(map[uint64]*segment),
+		nextID:       1,
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, nil, err
+	}
+	var ids []uint64
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), spoolSegmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	var replay []*spooledLog
+	for _, id := range ids {
+		seg := &segment{id: id, path: s.segmentPath(id)}
+		logs, err := s.readSegment(seg)
+		if err != nil {
+			s.logger.Errorf("klog.AsyncClient.Spool: segment corrupted, the rest of it is discarded, file=%s, err=%s", seg.path, err.Error())
+		}
+		if id >= s.nextID {
+			s.nextID = id + 1
+		}
+		if len(logs) == 0 {
+			_ = os.Remove(seg.path)
+			continue
+		}
+		seg.pending = len(logs)
+		s.segments[id] = seg
+		s.totalBytes += seg.size
+		for _, log := range logs {
+			replay = append(replay, &spooledLog{log: log, segment: seg})
+		}
+	}
+	return s, replay, nil
+}
+
+func (s *spool) segmentPath(id uint64) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", id, spoolSegmentExt))
+}
+
+// readSegment读取segment中的日志，直到文件结束或遇到损坏的记录。
+// seg.size被设置为有效内容的长度。
+func (s *spool) readSegment(seg *segment) ([]*pb.Log, error) {
+	data, err := ioutil.ReadFile(seg.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var logs []*pb.Log
+	var offset int64
+	for int64(len(data)) > offset {
+		rest := data[offset:]
+		if len(rest) < spoolRecordHeader {
+			return logs, io.ErrUnexpectedEOF
+		}
+		length := binary.BigEndian.Uint32(rest[0:4])
+		sum := binary.BigEndian.Uint32(rest[4:8])
+		if length > spoolMaxRecordSize || int64(len(rest)) < spoolRecordHeader+int64(length) {
+			return logs, fmt.Errorf("invalid record length %d at offset %d", length, offset)
+		}
+		payload := rest[spoolRecordHeader : spoolRecordHeader+length]
+		if crc32.Checksum(payload, spoolCRCTable) != sum {
+			return logs, fmt.Errorf("checksum mismatch at offset %d", offset)
+		}
+		log := &pb.Log{}
+		if err := proto.Unmarshal(payload, log); err != nil {
+			return logs, fmt.Errorf("invalid record at offset %d: %s", offset, err.Error())
+		}
+		logs = append(logs, log)
+		offset += spoolRecordHeader + int64(length)
+		seg.size = offset
+	}
+	return logs, nil
+}
+
+// append把一条日志写入当前segment，返回其所在的segment。
+// 日志序列化后超过spoolMaxRecordSize时返回错误。
+func (s *spool) append(log *pb.Log) (*segment, error) {
+	payload, err := proto.Marshal(log)
+	if err != nil {
+		return nil, err
+	}
+	// readSegment把超过spoolMaxRecordSize的记录视为损坏，这样的日志不能落盘
+	if len(payload) > spoolMaxRecordSize {
+		return nil, fmt.Errorf("the size of this log is %d and the spool record limit is %d", len(payload), spoolMaxRecordSize)
+	}
+	record := make([]byte, spoolRecordHeader+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, spoolCRCTable))
+	copy(record[spoolRecordHeader:], payload)
+	size := int64(len(record))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.totalBytes+size > s.maxBytes {
+		return nil, apierr.New(SpoolFull, fmt.Sprintf("the spool has reached its limit of %d bytes", s.maxBytes), nil)
+	}
+	if s.active == nil || (s.active.size > 0 && s.active.size+size > s.segmentBytes) {
+		if err := s.rotate(); err != nil {
+			return nil, err
+		}
+	}
+
+	seg := s.active
+	if _, err := seg.file.Write(record); err != nil {
+		// 写入不完整的记录会在重放时被识别为损坏，这里把文件恢复到写入前的长度
+		_ = seg.file.Truncate(seg.size)
+		_, _ = seg.file.Seek(seg.size, io.SeekStart)
+		return nil, err
+	}
+	seg.size += size
+	seg.pending++
+	s.totalBytes += size
+	return seg, nil
+}
+
+// rotate关闭当前segment并新建一个。调用者持有s.mu。
+func (s *spool) rotate() error {
+	id := s.nextID
+	path := s.segmentPath(id)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	s.nextID++
+
+	if prev := s.active; prev != nil {
+		_ = prev.file.Close()
+		prev.file = nil
+		if prev.pending == 0 {
+			s.remove(prev)
+		}
+	}
+	s.active = &segment{id: id, path: path, file: file}
+	s.segments[id] = s.active
+	return nil
+}
+
+// ack确认seg中的一条日志。segment中的日志全部确认后删除或截断该segment。
+func (s *spool) ack(seg *segment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seg.pending--
+	if seg.pending > 0 {
+		return
+	}
+	if seg != s.active {
+		s.remove(seg)
+		return
+	}
+	if err := seg.file.Truncate(0); err != nil {
+		s.logger.Errorf("klog.AsyncClient.Spool: failed to truncate segment, file=%s, err=%s", seg.path, err.Error())
+		return
+	}
+	_, _ = seg.file.Seek(0, io.SeekStart)
+	s.totalBytes -= seg.size
+	seg.size = 0
+}
+
+// remove删除一个已全部确认的segment。调用者持有s.mu。
+func (s *spool) remove(seg *segment) {
+	if err := os.Remove(seg.path); err != nil && !os.IsNotExist(err) {
+		s.logger.Errorf("klog.AsyncClient.Spool: failed to remove segment, file=%s, err=%s", seg.path, err.Error())
+	}
+	s.totalBytes -= seg.size
+	delete(s.segments, seg.id)
+}
+
+func (s *spool) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.active != nil {
+		_ = s.active.file.Close()
+		if s.active.pending == 0 {
+			s.remove(s.active)
+		}
+		s.active = nil
+	}
+}
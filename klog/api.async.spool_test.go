@@ -0,0 +1,237 @@
+package klog
+
+import (
+	"context"
+	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
+	"github.com/ks3sdk/klog-go-sdk/service"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func spoolBytes(t *testing.T, dir string) int64 {
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	var total int64
+	for _, f := range files {
+		total += f.Size()
+	}
+	return total
+}
+
+func TestAsyncClientSpoolReplay(t *testing.T) {
+	a := assert.New(t)
+	dir, err := ioutil.TempDir("", "klog-spool")
+	a.Nil(err)
+	defer os.RemoveAll(dir)
+
+	// 服务端不可用，日志留在落盘文件中
+	down := newFakeServer()
+	down.setHandle(func(*pb.LogGroup, *http.Request) (int, string) {
+		return http.StatusInternalServerError, InternalServerError
+	})
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName: "project",
+		LogPoolName: "pool",
+		SpoolDir:    dir,
+	}, down.config())
+	for i := 0; i < 10; i++ {
+		client.PushLog(makeTestLog("value"))
+	}
+	client.Stop(true)
+	down.Close()
+	a.True(spoolBytes(t, dir) > 0)
+
+	// 重新启动后发送剩余的日志
+	up := newFakeServer()
+	defer up.Close()
+	recorder := newCallbackRecorder()
+	client = NewAsyncClient(&AsyncClientOptions{
+		ProjectName: "project",
+		LogPoolName: "pool",
+		SpoolDir:    dir,
+		Callback:    recorder.callback,
+	}, up.config())
+	a.Nil(client.Close(context.Background()))
+
+	a.Equal(10, up.received())
+	unique, _ := recorder.count()
+	a.Equal(10, unique)
+	a.Equal(int64(0), spoolBytes(t, dir))
+}
+
+func TestAsyncClientSpoolFull(t *testing.T) {
+	a := assert.New(t)
+	dir, err := ioutil.TempDir("", "klog-spool")
+	a.Nil(err)
+	defer os.RemoveAll(dir)
+
+	server := newFakeServer()
+	defer server.Close()
+	recorder := newCallbackRecorder()
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName:   "project",
+		LogPoolName:   "pool",
+		Callback:      recorder.callback,
+		SpoolDir:      dir,
+		SpoolMaxBytes: 1,
+	}, server.config())
+
+	client.PushLog(makeTestLog("value"))
+	a.Nil(client.Close(context.Background()))
+	a.Equal(1, recorder.errorCount(SpoolFull))
+	a.Equal(0, server.received())
+}
+
+func TestSpoolCorruption(t *testing.T) {
+	a := assert.New(t)
+	dir, err := ioutil.TempDir("", "klog-spool")
+	a.Nil(err)
+	defer os.RemoveAll(dir)
+
+	s, replay, err := openSpool(dir, DefaultSpoolMaxBytes, DefaultSpoolSegmentBytes, new(service.EmptyLogger))
+	a.Nil(err)
+	a.Empty(replay)
+	for i := 0; i < 3; i++ {
+		_, err = s.append(makeTestLog("value"))
+		a.Nil(err)
+	}
+	s.close()
+
+	// 在文件末尾追加一条损坏的记录
+	path := filepath.Join(dir, "00000000000000000001"+spoolSegmentExt)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	a.Nil(err)
+	_, _ = f.Write([]byte{0, 0, 0, 4, 1, 2, 3, 4, 'b', 'a', 'd', '!'})
+	_ = f.Close()
+
+	s, replay, err = openSpool(dir, DefaultSpoolMaxBytes, DefaultSpoolSegmentBytes, new(service.EmptyLogger))
+	a.Nil(err)
+	a.Len(replay, 3)
+	for _, l := range replay {
+		a.Equal("value", l.log.Contents[0].Value)
+		s.ack(l.segment)
+	}
+	s.close()
+	_, err = os.Stat(path)
+	a.True(os.IsNotExist(err))
+}
+
+func TestSpoolRotate(t *testing.T) {
+	a := assert.New(t)
+	dir, err := ioutil.TempDir("", "klog-spool")
+	a.Nil(err)
+	defer os.RemoveAll(dir)
+
+	s, _, err := openSpool(dir, DefaultSpoolMaxBytes, 1, new(service.EmptyLogger))
+	a.Nil(err)
+	first, err := s.append(makeTestLog("a"))
+	a.Nil(err)
+	second, err := s.append(makeTestLog("b"))
+	a.Nil(err)
+	a.NotEqual(first.id, second.id)
+
+	// 已写满且全部确认的segment被删除
+	s.ack(first)
+	_, err = os.Stat(first.path)
+	a.True(os.IsNotExist(err))
+
+	// 正在写入的segment全部确认后被截断
+	s.ack(second)
+	info, err := os.Stat(second.path)
+	a.Nil(err)
+	a.Equal(int64(0), info.Size())
+	s.close()
+}
+
+func TestAsyncMultiPoolClientSpoolDirNames(t *testing.T) {
+	a := assert.New(t)
+	base, err := ioutil.TempDir("", "klog-spool")
+	a.Nil(err)
+	defer os.RemoveAll(base)
+	dir := filepath.Join(base, "spool")
+
+	// 项目名和日志池名可能来自日志内容，不能使落盘目录跳出SpoolDir
+	pools := [][2]string{{"..", ".."}, {".", "pool"}, {"project", "../../escape"}, {"..project", "pool.."}}
+	down := newFakeServer()
+	down.setHandle(func(*pb.LogGroup, *http.Request) (int, string) {
+		return http.StatusInternalServerError, InternalServerError
+	})
+	client := NewAsyncMultiPoolClient(&AsyncMultiPoolClientOptions{SpoolDir: dir}, down.config())
+	for _, p := range pools {
+		spoolDir := client.spoolDir(p[0], p[1])
+		rel, err := filepath.Rel(dir, spoolDir)
+		a.Nil(err)
+		a.Equal(2, len(strings.Split(rel, string(filepath.Separator))), spoolDir)
+		a.False(strings.HasPrefix(rel, ".."+string(filepath.Separator)), spoolDir)
+		client.PushLog(p[0], p[1], makeTestLog("value"))
+	}
+	a.Equal("", client.spoolDir("", "pool"))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_ = client.Close(ctx)
+	down.Close()
+
+	entries, err := ioutil.ReadDir(base)
+	a.Nil(err)
+	a.Len(entries, 1)
+
+	// 重新启动后按原来的名称恢复各日志池
+	up := newFakeServer()
+	defer up.Close()
+	var mu sync.Mutex
+	resumed := map[[2]string]bool{}
+	up.setHandle(func(_ *pb.LogGroup, r *http.Request) (int, string) {
+		mu.Lock()
+		resumed[[2]string{r.URL.Query().Get("ProjectName"), r.URL.Query().Get("LogPoolName")}] = true
+		mu.Unlock()
+		return 0, ""
+	})
+	client = NewAsyncMultiPoolClient(&AsyncMultiPoolClientOptions{SpoolDir: dir}, up.config())
+	a.Nil(client.Close(context.Background()))
+	a.Equal(len(pools), up.received())
+	for _, p := range pools {
+		a.True(resumed[p], "%q", p)
+	}
+}
+
+func TestAsyncClientSpoolReplayOversize(t *testing.T) {
+	a := assert.New(t)
+	dir, err := ioutil.TempDir("", "klog-spool")
+	a.Nil(err)
+	defer os.RemoveAll(dir)
+
+	down := newFakeServer()
+	down.setHandle(func(*pb.LogGroup, *http.Request) (int, string) {
+		return http.StatusInternalServerError, InternalServerError
+	})
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName:    "project",
+		LogPoolName:    "pool",
+		SpoolDir:       dir,
+		OversizePolicy: OversizeSplit,
+	}, down.config())
+	// 超过落盘记录上限的日志只保存在内存中，不影响之后的日志落盘
+	client.PushLog(makeTestLog(strings.Repeat("x", spoolMaxRecordSize+1)))
+	client.PushLog(makeTestLog("value"))
+	client.Stop(true)
+	down.Close()
+
+	up := newFakeServer()
+	defer up.Close()
+	client = NewAsyncClient(&AsyncClientOptions{
+		ProjectName: "project",
+		LogPoolName: "pool",
+		SpoolDir:    dir,
+	}, up.config())
+	a.Nil(client.Close(context.Background()))
+
+	a.Equal(1, up.received())
+	a.Equal(int64(0), spoolBytes(t, dir))
+}
@@ -0,0 +1,1097 @@
+package klog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/protobuf/proto"
+	"github.com/ks3sdk/klog-go-sdk/credentials"
+	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
+	"github.com/ks3sdk/klog-go-sdk/service"
+	"github.com/pierrec/lz4"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeServer模拟KLog服务端，记录收到的日志。
+type fakeServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	logs     []*pb.Log
+	requests int
+	// handle返回非空错误码时，以该错误码拒绝请求
+	handle func(lg *pb.LogGroup, r *http.Request) (status int, code string)
+}
+
+func newFakeServer() *fakeServer {
+	s := &fakeServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+func (s *fakeServer) serve(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.Header.Get("x-klog-compress-type") == "lz4" {
+		body, _ = ioutil.ReadAll(lz4.NewReader(strings.NewReader(string(body))))
+	}
+	lg := &pb.LogGroup{}
+	if err := proto.Unmarshal(body, lg); err != nil {
+		s.reject(w, http.StatusBadRequest, PostBodyInvalid)
+		return
+	}
+
+	s.mu.Lock()
+	s.requests++
+	handle := s.handle
+	s.mu.Unlock()
+	if handle != nil {
+		if status, code := handle(lg, r); code != "" {
+			s.reject(w, status, code)
+			return
+		}
+	}
+
+	s.mu.Lock()
+	s.logs = append(s.logs, lg.Logs...)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *fakeServer) reject(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"ErrorCode": code, "ErrorMessage": code})
+}
+
+func (s *fakeServer) setHandle(handle func(lg *pb.LogGroup, r *http.Request) (int, string)) {
+	s.mu.Lock()
+	s.handle = handle
+	s.mu.Unlock()
+}
+
+func (s *fakeServer) received() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.logs)
+}
+
+func (s *fakeServer) config() *service.Config {
+	return &service.Config{
+		Credentials: credentials.NewStaticCredentials("AK", "SK", ""),
+		Endpoint:    s.URL,
+		DisableSSL:  true,
+		MaxRetries:  0,
+	}
+}
+
+func makeTestLog(value string) *pb.Log {
+	return &pb.Log{
+		Time: time.Now().UnixNano() / 1000000,
+		Contents: []*pb.Log_Content{
+			{Key: "key", Value: value},
+		},
+	}
+}
+
+// callbackRecorder记录每个seqNo的回调结果。
+type callbackRecorder struct {
+	mu      sync.Mutex
+	results map[uint64]error
+	calls   int
+}
+
+func newCallbackRecorder() *callbackRecorder {
+	return &callbackRecorder{results: make(map[uint64]error)}
+}
+
+func (c *callbackRecorder) callback(_ *pb.Log, seqNo uint64, err error) {
+	c.mu.Lock()
+	c.results[seqNo] = err
+	c.calls++
+	c.mu.Unlock()
+}
+
+func (c *callbackRecorder) count() (int, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.results), c.calls
+}
+
+func (c *callbackRecorder) errorCount(code string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, err := range c.results {
+		if IsError(err, code) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestAsyncClientCloseDrains(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	recorder := newCallbackRecorder()
+
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName: "project",
+		LogPoolName: "pool",
+		Callback:    recorder.callback,
+	}, server.config())
+
+	for i := 0; i < 100; i++ {
+		client.PushLog(makeTestLog("value"))
+	}
+	a.Nil(client.Close(context.Background()))
+
+	a.Equal(100, server.received())
+	unique, calls := recorder.count()
+	a.Equal(100, unique)
+	a.Equal(100, calls)
+	a.Equal(0, recorder.errorCount(ClientShutdown))
+
+	// 关闭后推入的日志以ClientShutdown回调
+	client.PushLog(makeTestLog("late"))
+	a.Equal(1, recorder.errorCount(ClientShutdown))
+}
+
+func TestAsyncClientFlush(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName: "project",
+		LogPoolName: "pool",
+	}, server.config())
+	defer client.Stop(true)
+
+	for i := 0; i < 10; i++ {
+		client.PushLog(makeTestLog("value"))
+	}
+	a.Nil(client.Flush(context.Background()))
+	a.Equal(10, server.received())
+}
+
+func TestAsyncClientFlushWaitsForCallbacks(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+
+	var called int32
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName: "project",
+		LogPoolName: "pool",
+		Callback: func(log *pb.Log, seqNo uint64, err error) {
+			time.Sleep(50 * time.Millisecond)
+			atomic.StoreInt32(&called, 1)
+		},
+	}, server.config())
+	defer client.Stop(true)
+
+	// 过大的日志不进入batch，Flush仍需等待它的回调
+	client.PushLog(makeTestLog(strings.Repeat("x", MaxLogSize)))
+	a.Nil(client.Flush(context.Background()))
+	a.Equal(int32(1), atomic.LoadInt32(&called))
+}
+
+func TestAsyncClientCloseDeadline(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	server.setHandle(func(*pb.LogGroup, *http.Request) (int, string) {
+		return http.StatusInternalServerError, InternalServerError
+	})
+	recorder := newCallbackRecorder()
+
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName: "project",
+		LogPoolName: "pool",
+		Callback:    recorder.callback,
+	}, server.config())
+
+	for i := 0; i < 5; i++ {
+		client.PushLog(makeTestLog("value"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	a.Equal(context.DeadlineExceeded, client.Close(ctx))
+	// 等待剩余的日志回调
+	client.Stop(true)
+
+	unique, calls := recorder.count()
+	a.Equal(5, unique)
+	a.Equal(5, calls)
+	a.Equal(5, recorder.errorCount(ClientShutdown))
+}
+
+func TestAsyncClientStopStuckSender(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+
+	// sender尚未运行，模拟卡住的sender
+	s := newSender(1, time.Millisecond, nil)
+	options := &AsyncClientOptions{ProjectName: "project", LogPoolName: "pool"}
+	stopped := newAsyncClient(options, server.config(), s, nil)
+	closed := newAsyncClient(options, server.config(), s, nil)
+
+	returned := make(chan struct{})
+	go func() {
+		stopped.Stop(false)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		a.Equal(context.DeadlineExceeded, closed.Close(ctx))
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop(false) or Close waited for the stuck sender")
+	}
+
+	// sender恢复后两个客户端在后台停止
+	go s.run()
+	a.Nil(s.close(context.Background()))
+}
+
+func TestAsyncClientStopInterruptsSend(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	arrived := make(chan struct{}, 1)
+	release := make(chan struct{})
+	defer close(release)
+	server.setHandle(func(*pb.LogGroup, *http.Request) (int, string) {
+		arrived <- struct{}{}
+		<-release
+		return 0, ""
+	})
+	recorder := newCallbackRecorder()
+
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName: "project",
+		LogPoolName: "pool",
+		Callback:    recorder.callback,
+		Linger:      10 * time.Millisecond,
+	}, server.config())
+	client.PushLog(makeTestLog("value"))
+
+	select {
+	case <-arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not sent")
+	}
+	// 正在发送的请求被中断，不必等服务端响应
+	client.Stop(true)
+	a.Equal(1, recorder.errorCount(ClientShutdown))
+}
+
+func TestAsyncClientCircuitBreakerPausesRetries(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	server.setHandle(func(*pb.LogGroup, *http.Request) (int, string) {
+		return http.StatusServiceUnavailable, "ServiceUnavailable"
+	})
+	recorder := newCallbackRecorder()
+
+	cfg := server.config()
+	cfg.CircuitBreaker = service.NewCircuitBreaker(service.CircuitBreakerOptions{ConsecutiveFailures: 1, Cooldown: 300 * time.Millisecond})
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName: "project",
+		LogPoolName: "pool",
+		Callback:    recorder.callback,
+		Linger:      10 * time.Millisecond,
+		RetryPolicy: &FixedRetryPolicy{Delay: 10 * time.Millisecond, MaxAttempts: 2},
+	}, cfg)
+	defer client.Stop(true)
+
+	client.PushLog(makeTestLog("value"))
+	deadline := time.Now().Add(5 * time.Second)
+	for cfg.CircuitBreaker.State() != service.CircuitOpen && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.Equal(service.CircuitOpen, cfg.CircuitBreaker.State())
+
+	// 熔断期间的重试不计入MaxAttempts，服务恢复后日志发送成功
+	server.setHandle(nil)
+	a.Nil(client.Flush(context.Background()))
+	a.Equal(1, server.received())
+	unique, _ := recorder.count()
+	a.Equal(1, unique)
+	a.Equal(0, recorder.errorCount(RetryExhausted))
+	server.mu.Lock()
+	a.Equal(2, server.requests)
+	server.mu.Unlock()
+}
+
+func TestAsyncMultiPoolClientStopDrains(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	recorder := newCallbackRecorder()
+
+	client := NewAsyncMultiPoolClient(&AsyncMultiPoolClientOptions{
+		Callback: recorder.callback,
+	}, server.config())
+	for i := 0; i < 20; i++ {
+		client.PushLog("project", []string{"a", "b"}[i%2], makeTestLog("value"))
+	}
+	client.Stop()
+
+	a.Equal(20, server.received())
+	unique, _ := recorder.count()
+	a.Equal(20, unique)
+}
+
+// newBlockedClient返回一个发送线程阻塞在服务端、且已有batch积压的客户端，其发送队列不再被消费。
+func newBlockedClient(t *testing.T, options *AsyncClientOptions) (*AsyncClient, func()) {
+	server := newFakeServer()
+	gate := make(chan struct{})
+	entered := make(chan struct{}, 1)
+	server.setHandle(func(*pb.LogGroup, *http.Request) (int, string) {
+		select {
+		case entered <- struct{}{}:
+		default:
+		}
+		<-gate
+		return 0, ""
+	})
+
+	options.ProjectName = "project"
+	options.LogPoolName = "pool"
+	client := NewAsyncClient(options, server.config())
+	client.PushLog(makeTestLog("first"))
+	go func() { _ = client.Flush(context.Background()) }()
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("send never reached the server")
+	}
+
+	// 再封装一个batch，使其积压在发送线程之前
+	client.PushLog(makeTestLog("second"))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_ = client.Flush(ctx)
+
+	return client, func() {
+		close(gate)
+		_ = client.Close(context.Background())
+		server.Close()
+	}
+}
+
+func TestAsyncClientOverflowDropNewest(t *testing.T) {
+	a := assert.New(t)
+	recorder := newCallbackRecorder()
+	client, release := newBlockedClient(t, &AsyncClientOptions{
+		Callback:       recorder.callback,
+		QueueSize:      2,
+		OverflowPolicy: OverflowDropNewest,
+	})
+
+	client.PushLog(makeTestLog("a"))
+	client.PushLog(makeTestLog("b"))
+	seqNo := client.PushLog(makeTestLog("c"))
+	_, ok := client.TryPushLog(makeTestLog("d"))
+	a.False(ok)
+	a.Equal(2, recorder.errorCount(QueueOverflow))
+
+	release()
+	recorder.mu.Lock()
+	a.True(IsError(recorder.results[seqNo], QueueOverflow))
+	recorder.mu.Unlock()
+	unique, calls := recorder.count()
+	a.Equal(6, unique)
+	a.Equal(6, calls)
+}
+
+func TestAsyncClientOverflowDropOldest(t *testing.T) {
+	a := assert.New(t)
+	recorder := newCallbackRecorder()
+	client, release := newBlockedClient(t, &AsyncClientOptions{
+		Callback:       recorder.callback,
+		QueueSize:      2,
+		OverflowPolicy: OverflowDropOldest,
+	})
+
+	oldest := client.PushLog(makeTestLog("a"))
+	client.PushLog(makeTestLog("b"))
+	client.PushLog(makeTestLog("c"))
+	a.Equal(1, recorder.errorCount(QueueOverflow))
+
+	release()
+	recorder.mu.Lock()
+	a.True(IsError(recorder.results[oldest], QueueOverflow))
+	recorder.mu.Unlock()
+	a.Equal(1, recorder.errorCount(QueueOverflow))
+}
+
+func TestAsyncClientPushLogContext(t *testing.T) {
+	a := assert.New(t)
+	recorder := newCallbackRecorder()
+	client, release := newBlockedClient(t, &AsyncClientOptions{
+		Callback:  recorder.callback,
+		QueueSize: 1,
+	})
+	defer release()
+
+	_, err := client.PushLogContext(context.Background(), makeTestLog("a"))
+	a.Nil(err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.PushLogContext(ctx, makeTestLog("b"))
+	a.True(IsError(err, QueueOverflow))
+	a.Equal(1, recorder.errorCount(QueueOverflow))
+}
+
+func TestAsyncClientOverflowBlockWithTimeout(t *testing.T) {
+	a := assert.New(t)
+	recorder := newCallbackRecorder()
+	client, release := newBlockedClient(t, &AsyncClientOptions{
+		Callback:        recorder.callback,
+		QueueSize:       1,
+		OverflowPolicy:  OverflowBlockWithTimeout,
+		OverflowTimeout: 50 * time.Millisecond,
+	})
+	defer release()
+
+	client.PushLog(makeTestLog("a"))
+	start := time.Now()
+	client.PushLog(makeTestLog("b"))
+	a.True(time.Since(start) >= 50*time.Millisecond)
+	a.Equal(1, recorder.errorCount(QueueOverflow))
+}
+
+// sealNow封装客户端中已推入的日志，不等待发送完成。
+func sealNow(client *AsyncClient) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_ = client.Flush(ctx)
+}
+
+func maxConcurrentRequests(t *testing.T, options *AsyncClientOptions) int {
+	server := newFakeServer()
+	defer server.Close()
+	var mu sync.Mutex
+	current, max := 0, 0
+	server.setHandle(func(*pb.LogGroup, *http.Request) (int, string) {
+		mu.Lock()
+		current++
+		if current > max {
+			max = current
+		}
+		mu.Unlock()
+		time.Sleep(200 * time.Millisecond)
+		mu.Lock()
+		current--
+		mu.Unlock()
+		return 0, ""
+	})
+
+	options.ProjectName = "project"
+	options.LogPoolName = "pool"
+	client := NewAsyncClient(options, server.config())
+	for i := 0; i < 4; i++ {
+		client.PushLog(makeTestLog("value"))
+		sealNow(client)
+	}
+	assert.Nil(t, client.Close(context.Background()))
+	assert.Equal(t, 4, server.received())
+
+	mu.Lock()
+	defer mu.Unlock()
+	return max
+}
+
+func TestAsyncClientSendWorkers(t *testing.T) {
+	a := assert.New(t)
+	a.True(maxConcurrentRequests(t, &AsyncClientOptions{SendWorkers: 4}) > 1)
+	a.Equal(1, maxConcurrentRequests(t, &AsyncClientOptions{SendWorkers: 4, Ordering: OrderingStrict}))
+}
+
+func TestAsyncClientBatching(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName:   "project",
+		LogPoolName:   "pool",
+		Linger:        50 * time.Millisecond,
+		MaxBatchCount: 10,
+	}, server.config())
+	defer client.Stop(true)
+
+	for i := 0; i < 25; i++ {
+		client.PushLog(makeTestLog("value"))
+	}
+	// 满10条的两个batch立即发送，剩余5条在linger后发送
+	deadline := time.Now().Add(time.Second)
+	for server.received() < 25 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	a.Equal(25, server.received())
+	server.mu.Lock()
+	a.Equal(3, server.requests)
+	server.mu.Unlock()
+}
+
+func TestAsyncClientOptionsValidate(t *testing.T) {
+	a := assert.New(t)
+	a.Nil((&AsyncClientOptions{}).Validate())
+	a.Nil((&AsyncClientOptions{Linger: time.Millisecond, MaxBatchBytes: MaxLogGroupSize, MaxBatchCount: MaxBulkSize}).Validate())
+	a.True(IsError((&AsyncClientOptions{MaxBatchBytes: MaxLogGroupSize + 1}).Validate(), InvalidOptions))
+	a.True(IsError((&AsyncClientOptions{MaxBatchCount: MaxBulkSize + 1}).Validate(), InvalidOptions))
+	a.True(IsError((&AsyncClientOptions{Linger: -time.Second}).Validate(), InvalidOptions))
+
+	// NewAsyncClient对不合法的选项使用默认值
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName:   "project",
+		LogPoolName:   "pool",
+		Linger:        -time.Second,
+		MaxBatchBytes: MaxLogGroupSize + 1,
+		MaxBatchCount: -1,
+	}, nil)
+	a.Equal(DefaultLinger, client.linger)
+	a.Equal(LogGroupSizeToSend, client.maxBatchBytes)
+	a.Equal(MaxBulkSize, client.maxBatchCount)
+	client.Stop(true)
+}
+
+func TestAsyncClientBatchCallback(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	var requestIds []string
+	server.setHandle(func(_ *pb.LogGroup, r *http.Request) (int, string) {
+		requestIds = append(requestIds, r.Header.Get("X-KSC-REQUEST-ID"))
+		return 0, ""
+	})
+
+	var results []*BatchResult
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName: "project",
+		LogPoolName: "pool",
+		BatchCallback: func(result *BatchResult) {
+			results = append(results, result)
+		},
+	}, server.config())
+
+	var seqNos []uint64
+	for i := 0; i < 3; i++ {
+		seqNos = append(seqNos, client.PushLog(makeTestLog("value")))
+	}
+	a.Nil(client.Close(context.Background()))
+
+	a.Len(results, 1)
+	result := results[0]
+	a.Nil(result.Err)
+	a.Equal("project", result.ProjectName)
+	a.Equal("pool", result.LogPoolName)
+	a.Equal(seqNos, result.SeqNos)
+	a.Len(result.LogGroup.Logs, 3)
+	a.Equal(1, result.Attempts)
+	a.Equal(requestIds, []string{result.RequestID})
+	a.Equal(proto.Size(result.LogGroup), result.RawSize)
+	a.True(result.CompressedSize > 0)
+}
+
+func TestAsyncClientBisectRejectedBatch(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	server.setHandle(func(lg *pb.LogGroup, _ *http.Request) (int, string) {
+		for _, log := range lg.Logs {
+			if log.Contents[0].Value == "poison" {
+				return http.StatusBadRequest, PostBodyInvalid
+			}
+		}
+		if len(lg.Logs) > 4 {
+			return http.StatusBadRequest, MaxBulkSizeExceeded
+		}
+		return 0, ""
+	})
+
+	recorder := newCallbackRecorder()
+	var batches int
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName:   "project",
+		LogPoolName:   "pool",
+		Callback:      recorder.callback,
+		BatchCallback: func(*BatchResult) { batches++ },
+	}, server.config())
+
+	var poison uint64
+	for i := 0; i < 16; i++ {
+		if i == 11 {
+			poison = client.PushLog(makeTestLog("poison"))
+		} else {
+			client.PushLog(makeTestLog("value"))
+		}
+	}
+	a.Nil(client.Close(context.Background()))
+
+	results, calls := recorder.count()
+	a.Equal(16, results)
+	a.Equal(16, calls)
+	a.Equal(15, server.received())
+	a.Equal(1, recorder.errorCount(PostBodyInvalid))
+	a.True(IsError(recorder.results[poison], PostBodyInvalid))
+	a.Equal(DeliveryRejectedInvalid, ClassifyDelivery(recorder.results[poison]))
+	a.True(batches > 1)
+}
+
+func TestAsyncMultiPoolClientIdleEviction(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	recorder := newCallbackRecorder()
+
+	client := NewAsyncMultiPoolClient(&AsyncMultiPoolClientOptions{
+		Callback:    recorder.callback,
+		Linger:      10 * time.Millisecond,
+		IdleTimeout: 50 * time.Millisecond,
+	}, server.config())
+	defer client.Stop()
+
+	client.PushLog("project", "a", makeTestLog("value"))
+	client.PushLog("project", "b", makeTestLog("value"))
+	a.Len(client.Clients(), 2)
+
+	// b持续推入，a空闲后被移除
+	deadline := time.Now().Add(2 * time.Second)
+	for len(client.Clients()) == 2 && time.Now().Before(deadline) {
+		client.PushLog("project", "b", makeTestLog("value"))
+		time.Sleep(5 * time.Millisecond)
+	}
+	infos := client.Clients()
+	a.Len(infos, 1)
+	a.Equal("b", infos[0].LogPoolName)
+
+	// 再次推入时重新创建
+	a.Nil(client.PushLogWithResult("project", "a", makeTestLog("value")).Wait(context.Background()))
+	a.Len(client.Clients(), 2)
+	_, calls := recorder.count()
+	a.Equal(server.received(), calls)
+}
+
+func TestAsyncMultiPoolClientRemovePool(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+
+	client := NewAsyncMultiPoolClient(&AsyncMultiPoolClientOptions{}, server.config())
+	for i := 0; i < 10; i++ {
+		client.PushLog("project", "a", makeTestLog("value"))
+	}
+	a.Nil(client.RemovePool(context.Background(), "project", "a"))
+	a.Equal(10, server.received())
+	a.Empty(client.Clients())
+	a.Nil(client.RemovePool(context.Background(), "project", "missing"))
+
+	a.Nil(client.Close(context.Background()))
+	delivery := client.PushLogWithResult("project", "a", makeTestLog("value"))
+	a.Equal(DeliveryShutdown, delivery.Outcome())
+	a.Empty(client.Clients())
+}
+
+func TestAsyncMultiPoolClientConcurrentCreate(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+
+	client := NewAsyncMultiPoolClient(&AsyncMultiPoolClientOptions{}, server.config())
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			client.PushLog("project", "pool", makeTestLog("value"))
+		}()
+	}
+	wg.Wait()
+	a.Len(client.Clients(), 1)
+	a.Nil(client.Close(context.Background()))
+	a.Equal(50, server.received())
+}
+
+func TestAsyncMultiPoolClientSharedSender(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	server.setHandle(func(_ *pb.LogGroup, r *http.Request) (int, string) {
+		if r.URL.Query().Get("LogPoolName") == "bad" {
+			return http.StatusInternalServerError, "InternalError"
+		}
+		return 0, ""
+	})
+
+	before := runtime.NumGoroutine()
+	client := NewAsyncMultiPoolClient(&AsyncMultiPoolClientOptions{
+		TotalSendWorkers: 1,
+		Linger:           10 * time.Millisecond,
+		RetryPolicy:      &FixedRetryPolicy{Delay: time.Hour},
+	}, server.config())
+
+	// 持续失败的日志池等待重试时，不占用唯一的发送线程
+	for i := 0; i < 3; i++ {
+		client.PushLog("project", "bad", makeTestLog("value"))
+		sealNow(client.client("project", "bad"))
+	}
+	for i := 0; i < 200; i++ {
+		client.PushLog("project", fmt.Sprintf("pool-%d", i), makeTestLog("value"))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 200; i++ {
+		a.Nil(client.client("project", fmt.Sprintf("pool-%d", i)).Flush(ctx))
+	}
+	a.Equal(200, server.received())
+
+	// 日志池不再各自拥有goroutine
+	a.True(runtime.NumGoroutine()-before < 50)
+
+	stopCtx, stopCancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer stopCancel()
+	a.Equal(context.DeadlineExceeded, client.Close(stopCtx))
+}
+
+func TestAsyncClientMaxBufferedBytes(t *testing.T) {
+	a := assert.New(t)
+	recorder := newCallbackRecorder()
+	size := int64(proto.Size(makeTestLog("second")))
+	client, release := newBlockedClient(t, &AsyncClientOptions{
+		Callback:         recorder.callback,
+		OverflowPolicy:   OverflowDropNewest,
+		MaxBufferedBytes: 2 * size,
+	})
+
+	// first在发送中，second积压，预算已用完
+	for i := 0; i < 3; i++ {
+		_, ok := client.TryPushLog(makeTestLog("third"))
+		a.False(ok)
+	}
+	a.Equal(3, recorder.errorCount(QueueOverflow))
+
+	release()
+	results, _ := recorder.count()
+	a.Equal(5, results)
+	a.Equal(3, recorder.errorCount(QueueOverflow))
+}
+
+func TestAsyncClientMaxBufferedBytesSlowCallback(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+
+	gate := make(chan struct{})
+	size := int64(proto.Size(makeTestLog("value")))
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName:      "project",
+		LogPoolName:      "pool",
+		Linger:           10 * time.Millisecond,
+		MaxBatchCount:    1,
+		MaxBufferedBytes: 2 * size,
+		Callback: func(log *pb.Log, seqNo uint64, err error) {
+			if err == nil {
+				<-gate
+			}
+		},
+	}, server.config())
+
+	// 第一条日志的回调阻塞，之后的日志发送完成后仍在等待回调
+	for i := 0; i < 3; i++ {
+		client.PushLog(makeTestLog("value"))
+	}
+	for server.received() < 3 {
+		time.Sleep(time.Millisecond)
+	}
+	// 等待回调的日志仍占用预算
+	_, ok := client.TryPushLog(makeTestLog("value"))
+	a.False(ok)
+
+	close(gate)
+	a.Nil(client.Flush(context.Background()))
+	_, ok = client.TryPushLog(makeTestLog("value"))
+	a.True(ok)
+	a.Nil(client.Close(context.Background()))
+	a.Equal(4, server.received())
+}
+
+func TestAsyncMultiPoolClientMaxTotalBufferedBytes(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	gate := make(chan struct{})
+	server.setHandle(func(*pb.LogGroup, *http.Request) (int, string) {
+		<-gate
+		return 0, ""
+	})
+
+	size := int64(proto.Size(makeTestLog("value")))
+	client := NewAsyncMultiPoolClient(&AsyncMultiPoolClientOptions{
+		OverflowPolicy:        OverflowBlockWithTimeout,
+		OverflowTimeout:       50 * time.Millisecond,
+		MaxTotalBufferedBytes: 2 * size,
+	}, server.config())
+
+	client.PushLog("project", "a", makeTestLog("value"))
+	client.PushLog("project", "b", makeTestLog("value"))
+	_, err := client.PushLogContext(context.Background(), "project", "c", makeTestLog("value"))
+	a.True(IsError(err, QueueOverflow))
+
+	// 日志发送后预算被释放
+	close(gate)
+	a.Nil(client.Flush(context.Background()))
+	_, err = client.PushLogContext(context.Background(), "project", "c", makeTestLog("value"))
+	a.Nil(err)
+	a.Nil(client.Close(context.Background()))
+	a.Equal(3, server.received())
+}
+
+func TestAsyncMultiPoolClientPoolLinger(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+
+	client := NewAsyncMultiPoolClient(&AsyncMultiPoolClientOptions{
+		Linger: 10 * time.Second,
+		PoolOptions: func(options *AsyncClientOptions) {
+			if options.LogPoolName == "fast" {
+				options.Linger = 10 * time.Millisecond
+			}
+		},
+	}, server.config())
+
+	// 共用的sender按最短的Linger检查，不等待默认Linger的1/10
+	client.PushLog("project", "fast", makeTestLog("value"))
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for server.received() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	a.Equal(1, server.received())
+	a.Nil(client.Close(context.Background()))
+}
+
+func TestAsyncMultiPoolClientPoolOptions(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	server.setHandle(func(*pb.LogGroup, *http.Request) (int, string) {
+		return http.StatusNotFound, ProjectOrLogPoolNotExist
+	})
+
+	defaults := newCallbackRecorder()
+	audit := newCallbackRecorder()
+	client := NewAsyncMultiPoolClient(&AsyncMultiPoolClientOptions{
+		Callback:            defaults.callback,
+		DropIfPoolNotExists: true,
+		QueueSize:           100,
+		PoolOptions: func(options *AsyncClientOptions) {
+			if options.LogPoolName == "audit" {
+				options.Callback = audit.callback
+				options.DropIfPoolNotExists = false
+				options.QueueSize = 10
+				options.LogPoolName = "ignored"
+			}
+		},
+	}, server.config())
+
+	a.Equal(100, cap(client.client("project", "debug").ch))
+	auditClient := client.client("project", "audit")
+	a.Equal(10, cap(auditClient.ch))
+	a.Equal("audit", auditClient.LogPoolName)
+
+	client.PushLog("project", "debug", makeTestLog("value"))
+	client.PushLog("project", "audit", makeTestLog("value"))
+	a.Nil(client.RemovePool(context.Background(), "project", "debug"))
+	a.Equal(1, defaults.errorCount(ProjectOrLogPoolNotExist))
+
+	// audit不丢弃，一直重试到被停止
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	a.Equal(context.DeadlineExceeded, client.Close(ctx))
+	auditClient.Stop(true)
+	a.Equal(1, audit.errorCount(ClientShutdown))
+	results, _ := defaults.count()
+	a.Equal(1, results)
+}
+
+// BenchmarkAsyncClient每次推入并发送一个512条日志的batch。
+func BenchmarkAsyncClient(b *testing.B) {
+	logs := make([]*pb.Log, 512)
+	for i := range logs {
+		logs[i] = makeTestLog(strings.Repeat(fmt.Sprintf("value-%d ", i), 20))
+	}
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName:   "project",
+		LogPoolName:   "pool",
+		MaxBatchCount: len(logs),
+		QueueSize:     len(logs),
+	}, &service.Config{
+		Credentials: credentials.NewStaticCredentials("AK", "SK", ""),
+		Endpoint:    "127.0.0.1",
+		HTTPClient:  &http.Client{Transport: discardTransport{}},
+	})
+	defer client.Stop(true)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, log := range logs {
+			client.PushLog(log)
+		}
+		if err := client.Flush(context.Background()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestAsyncClientPushFromCallback(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+
+	sent := make(chan error, 1)
+	var client *AsyncClient
+	client = NewAsyncClient(&AsyncClientOptions{
+		ProjectName: "project",
+		LogPoolName: "pool",
+		Linger:      10 * time.Millisecond,
+		Callback: func(log *pb.Log, seqNo uint64, err error) {
+			if IsError(err, MaxLogSizeExceeded) {
+				// 在sender的goroutine中被丢弃的日志，回调中重新推入一条较小的日志
+				client.PushLog(makeTestLog("small"))
+				return
+			}
+			sent <- err
+		},
+	}, server.config())
+
+	client.PushLog(makeTestLog(strings.Repeat("v", MaxLogSize)))
+	select {
+	case err := <-sent:
+		a.Nil(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("PushLog in the callback deadlocked")
+	}
+	a.Nil(client.Close(context.Background()))
+	a.Equal(1, server.received())
+}
+
+func TestAsyncMultiPoolClientPushFromCallback(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+
+	sent := make(chan string, 1)
+	var client *AsyncMultiPoolClient
+	client = NewAsyncMultiPoolClient(&AsyncMultiPoolClientOptions{
+		Linger: 10 * time.Millisecond,
+		Callback: func(log *pb.Log, seqNo uint64, err error) {
+			if IsError(err, MaxLogSizeExceeded) {
+				// 回调中推入新的日志池，创建客户端时通知共用的sender
+				client.PushLog("project", "other", makeTestLog("small"))
+				return
+			}
+			sent <- log.Contents[0].Value
+		},
+	}, server.config())
+
+	client.PushLog("project", "pool", makeTestLog(strings.Repeat("v", MaxLogSize)))
+	select {
+	case value := <-sent:
+		a.Equal("small", value)
+	case <-time.After(5 * time.Second):
+		t.Fatal("PushLog in the callback deadlocked")
+	}
+	a.Nil(client.Close(context.Background()))
+}
+
+func TestAsyncClientCallbacksNotConcurrent(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+
+	var running, overlapped, calls int32
+	enter := func() {
+		if atomic.AddInt32(&running, 1) > 1 {
+			atomic.StoreInt32(&overlapped, 1)
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&running, -1)
+	}
+	client := NewAsyncClient(&AsyncClientOptions{
+		ProjectName:   "project",
+		LogPoolName:   "pool",
+		SendWorkers:   4,
+		MaxBatchCount: 1,
+		Callback: func(log *pb.Log, seqNo uint64, err error) {
+			atomic.AddInt32(&calls, 1)
+			enter()
+		},
+		BatchCallback: func(result *BatchResult) {
+			enter()
+		},
+	}, server.config())
+
+	// 发送线程和sender的goroutine都会产生结果
+	for i := 0; i < 20; i++ {
+		client.PushLog(makeTestLog("value"))
+		client.PushLog(makeTestLog(strings.Repeat("v", MaxLogSize)))
+	}
+	a.Nil(client.Close(context.Background()))
+	a.Equal(int32(40), atomic.LoadInt32(&calls))
+	a.Equal(int32(0), atomic.LoadInt32(&overlapped))
+}
+
+func TestAsyncMultiPoolClientSharesEndpointHealth(t *testing.T) {
+	a := assert.New(t)
+	primary := newFakeServer()
+	defer primary.Close()
+	fallback := newFakeServer()
+	defer fallback.Close()
+	primary.setHandle(func(lg *pb.LogGroup, r *http.Request) (int, string) {
+		return http.StatusServiceUnavailable, "ServiceUnavailable"
+	})
+
+	cfg := primary.config()
+	cfg.Endpoints = []string{fallback.URL}
+	cfg.EndpointFailureThreshold = 2
+	cfg.EndpointEjectDuration = time.Minute
+	client := NewAsyncMultiPoolClient(&AsyncMultiPoolClientOptions{
+		Linger:      10 * time.Millisecond,
+		RetryPolicy: &FixedRetryPolicy{Delay: 10 * time.Millisecond},
+	}, cfg)
+
+	// 一个日志池隔离主地址后，其他日志池不再向主地址发送
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client.PushLog("project", "pool-0", makeTestLog("value"))
+	a.Nil(client.client("project", "pool-0").Flush(ctx))
+	for i := 1; i < 5; i++ {
+		pool := fmt.Sprintf("pool-%d", i)
+		client.PushLog("project", pool, makeTestLog("value"))
+		a.Nil(client.client("project", pool).Flush(ctx))
+	}
+	a.Nil(client.Close(ctx))
+
+	primary.mu.Lock()
+	a.Equal(2, primary.requests)
+	primary.mu.Unlock()
+	a.Equal(5, fallback.received())
+}
@@ -1,10 +1,11 @@
 package klog
 
 import (
-	"github.com/golang/protobuf/proto"
+	"context"
 	v2 "github.com/ks3sdk/klog-go-sdk/internal/signer"
 	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
 	"github.com/ks3sdk/klog-go-sdk/service"
+	"google.golang.org/protobuf/proto"
 	"net/url"
 	"sync"
 )
@@ -21,6 +22,9 @@ var initService func(*service.Service)
 // Used for custom request initialization logic
 var initRequest func(*service.Request)
 
+// SignHandlerName 是签名处理函数在 Handlers.Sign 中注册的名称，可用于替换或移除签名
+const SignHandlerName = v2.SignHandlerName
+
 func New(config *service.Config) *Klog {
 	s := &service.Service{
 		Config:     service.DefaultConfig.Merge(config),
@@ -29,7 +33,7 @@ func New(config *service.Config) *Klog {
 
 	s.Initialize()
 
-	s.Handlers.Sign.PushBack(v2.Sign)
+	s.Handlers.Sign.PushBackNamed(service.NamedHandler{Name: v2.SignHandlerName, Fn: v2.Sign})
 
 	return &Klog{s}
 }
@@ -66,15 +70,45 @@ func (k *Klog) PutLogsRequest(input []byte, params *url.Values) (req *service.Re
 
 // 底层API，一次上传多条log到指定日志池。是同步调用。
 func (k *Klog) PutLogs(input *pb.LogGroup, targetProject, targetLogPool string) error {
+	return k.PutLogsWithContext(context.Background(), input, targetProject, targetLogPool)
+}
+
+// PutLogsWithContext同PutLogs，ctx结束时中断请求和重试前的等待，返回RequestCanceled错误。
+func (k *Klog) PutLogsWithContext(ctx context.Context, input *pb.LogGroup, targetProject, targetLogPool string) error {
+	_, _, err := k.putLogs(ctx, input, targetProject, targetLogPool)
+	return err
+}
+
+// putLogs同PutLogs，同时返回发送过的请求和压缩前的请求体大小，
+// 用于获取请求ID、重试次数和实际发送的字节数。序列化失败时返回的请求为nil。
+func (k *Klog) putLogs(ctx context.Context, input *pb.LogGroup, targetProject, targetLogPool string) (*service.Request, int, error) {
+	buf := service.GetBuffer()
+	bb, err := proto.MarshalOptions{}.MarshalAppend(*buf, input)
+	if err != nil {
+		service.PutBuffer(buf)
+		return nil, 0, err
+	}
+	*buf = bb
+	req, err := k.putLogsBody(ctx, bb, func() {
+		service.PutBuffer(buf)
+	}, targetProject, targetLogPool)
+	return req, len(bb), err
+}
+
+// putLogsBody发送已经序列化的LogGroup。请求体不再被使用时调用release，可以为nil。
+// 返回的请求只可读取请求ID、重试次数等信息，不可再读取请求体。
+func (k *Klog) putLogsBody(ctx context.Context, body []byte, release func(), targetProject, targetLogPool string) (*service.Request, error) {
 	params := &url.Values{}
 	params.Add("ProjectName", targetProject)
 	params.Add("LogPoolName", targetLogPool)
 
-	bb, err := proto.Marshal(input)
-	if err != nil {
-		return err
+	req := k.PutLogsRequest(body, params)
+	req.SetContext(ctx)
+	if release != nil {
+		req.OnRelease(release)
 	}
-	req := k.PutLogsRequest(bb, params)
-	err = req.Send()
-	return err
+	err := req.Send()
+	// 归还请求体和压缩用的缓冲区
+	req.Release()
+	return req, err
 }
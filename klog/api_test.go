@@ -0,0 +1,250 @@
+package klog
+
+import (
+	"context"
+	"fmt"
+	"github.com/ks3sdk/klog-go-sdk/credentials"
+	pb "github.com/ks3sdk/klog-go-sdk/protobuf"
+	"github.com/ks3sdk/klog-go-sdk/service"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPutLogsEndpointFailover(t *testing.T) {
+	a := assert.New(t)
+	primary := newFakeServer()
+	defer primary.Close()
+	fallback := newFakeServer()
+	defer fallback.Close()
+
+	primary.setHandle(func(lg *pb.LogGroup, r *http.Request) (int, string) {
+		return http.StatusServiceUnavailable, "ServiceUnavailable"
+	})
+	cfg := primary.config()
+	cfg.Endpoints = []string{fallback.URL}
+	cfg.EndpointFailureThreshold = 2
+	cfg.EndpointEjectDuration = 100 * time.Millisecond
+	client := New(cfg)
+	put := func() error {
+		return client.PutLogs(&pb.LogGroup{Logs: []*pb.Log{makeTestLog("v")}}, "project", "pool")
+	}
+
+	// 连续失败达到阈值后切换到备用地址
+	a.Error(put())
+	a.Error(put())
+	a.NoError(put())
+	a.NoError(put())
+	a.Equal(2, fallback.received())
+
+	// 主地址恢复后，隔离时间结束时的探测请求成功，切回主地址
+	primary.setHandle(nil)
+	time.Sleep(150 * time.Millisecond)
+	a.NoError(put())
+	a.NoError(put())
+	a.Equal(2, primary.received())
+	a.Equal(2, fallback.received())
+}
+
+func TestPutLogsSharedEndpointHealth(t *testing.T) {
+	a := assert.New(t)
+	primary := newFakeServer()
+	defer primary.Close()
+	fallback := newFakeServer()
+	defer fallback.Close()
+	primary.setHandle(func(lg *pb.LogGroup, r *http.Request) (int, string) {
+		return http.StatusServiceUnavailable, "ServiceUnavailable"
+	})
+
+	cfg := primary.config()
+	cfg.Endpoints = []string{fallback.URL}
+	cfg.EndpointHealth = service.NewEndpointHealth(service.EndpointHealthOptions{FailureThreshold: 2, EjectDuration: time.Minute})
+	client1, client2 := New(cfg), New(cfg)
+	lg := &pb.LogGroup{Logs: []*pb.Log{makeTestLog("v")}}
+
+	// 第一个客户端隔离主地址后，第二个客户端直接使用备用地址
+	a.Error(client1.PutLogs(lg, "project", "pool"))
+	a.Error(client1.PutLogs(lg, "project", "pool"))
+	a.NoError(client2.PutLogs(lg, "project", "pool"))
+	primary.mu.Lock()
+	a.Equal(2, primary.requests)
+	primary.mu.Unlock()
+	a.Equal(1, fallback.received())
+}
+
+func TestPutLogsWithContext(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	release := make(chan struct{})
+	defer close(release)
+	server.setHandle(func(lg *pb.LogGroup, r *http.Request) (int, string) {
+		<-release
+		return 0, ""
+	})
+
+	client := New(server.config())
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := client.PutLogsWithContext(ctx, &pb.LogGroup{Logs: []*pb.Log{makeTestLog("v")}}, "project", "pool")
+	a.True(IsError(err, RequestCanceled))
+}
+
+func TestPutLogsSharedRateLimiter(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+
+	cfg := server.config()
+	cfg.RateLimiter = service.NewRateLimiter(service.RateLimiterOptions{RequestsPerSecond: 1, RequestBurst: 1})
+	client1, client2 := New(cfg), New(cfg)
+	lg := &pb.LogGroup{Logs: []*pb.Log{makeTestLog("v")}}
+
+	// 两个客户端共用限流，第二个请求需要等待约1秒
+	a.NoError(client1.PutLogs(lg, "project", "pool"))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := client2.PutLogsWithContext(ctx, lg, "project", "pool")
+	a.True(IsError(err, RequestCanceled))
+	a.Equal(1, server.received())
+	a.Equal(int64(1), cfg.RateLimiter.Stats().Canceled)
+}
+
+func TestPutLogsCircuitBreaker(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	server.setHandle(func(lg *pb.LogGroup, r *http.Request) (int, string) {
+		return http.StatusServiceUnavailable, "ServiceUnavailable"
+	})
+
+	var mu sync.Mutex
+	var changes []string
+	breaker := service.NewCircuitBreaker(service.CircuitBreakerOptions{ConsecutiveFailures: 2, Cooldown: 100 * time.Millisecond})
+	breaker.OnStateChange(func(from, to service.CircuitState) {
+		mu.Lock()
+		changes = append(changes, from.String()+"->"+to.String())
+		mu.Unlock()
+	})
+	cfg := server.config()
+	cfg.CircuitBreaker = breaker
+	client := New(cfg)
+	lg := &pb.LogGroup{Logs: []*pb.Log{makeTestLog("v")}}
+
+	// 连续失败后熔断，请求不再发出
+	a.Error(client.PutLogs(lg, "project", "pool"))
+	a.Error(client.PutLogs(lg, "project", "pool"))
+	a.Equal(service.CircuitOpen, breaker.State())
+	a.True(IsError(client.PutLogs(lg, "project", "pool"), CircuitOpen))
+	server.mu.Lock()
+	a.Equal(2, server.requests)
+	server.mu.Unlock()
+
+	// 冷却后半开，探测成功后恢复
+	server.setHandle(nil)
+	time.Sleep(200 * time.Millisecond)
+	a.Equal(service.CircuitHalfOpen, breaker.State())
+	a.NoError(client.PutLogs(lg, "project", "pool"))
+	a.Equal(service.CircuitClosed, breaker.State())
+
+	mu.Lock()
+	a.Equal([]string{"closed->open", "open->half-open", "half-open->closed"}, changes)
+	mu.Unlock()
+}
+
+func TestPutLogsCircuitOpenSkipsRateLimiter(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+	server.setHandle(func(lg *pb.LogGroup, r *http.Request) (int, string) {
+		return http.StatusServiceUnavailable, "ServiceUnavailable"
+	})
+
+	breaker := service.NewCircuitBreaker(service.CircuitBreakerOptions{ConsecutiveFailures: 1, Cooldown: time.Minute})
+	cfg := server.config()
+	cfg.CircuitBreaker = breaker
+	cfg.RateLimiter = service.NewRateLimiter(service.RateLimiterOptions{RequestsPerSecond: 1, RequestBurst: 1})
+	client := New(cfg)
+	lg := &pb.LogGroup{Logs: []*pb.Log{makeTestLog("v")}}
+
+	a.Error(client.PutLogs(lg, "project", "pool"))
+	a.Equal(service.CircuitOpen, breaker.State())
+
+	// 熔断时立即失败，不等待限流
+	start := time.Now()
+	a.True(IsError(client.PutLogs(lg, "project", "pool"), CircuitOpen))
+	a.True(time.Since(start) < 500*time.Millisecond)
+}
+
+func TestPutLogsCustomHandlers(t *testing.T) {
+	a := assert.New(t)
+	server := newFakeServer()
+	defer server.Close()
+
+	client := New(server.config())
+	var signed, sent []string
+	// 在签名之后插入处理函数，并用自定义的发送替换SendHandler
+	a.True(client.Handlers.Sign.InsertAfter(SignHandlerName, service.NamedHandler{Name: "test.Signed", Fn: func(r *service.Request) {
+		signed = append(signed, r.HTTPRequest.Header.Get("Authorization"))
+	}}))
+	a.True(client.Handlers.Send.Swap(service.SendHandlerName, service.NamedHandler{Name: "test.Send", Fn: func(r *service.Request) {
+		sent = append(sent, r.HTTPRequest.URL.Path)
+		service.SendHandler(r)
+	}}))
+
+	a.NoError(client.PutLogs(&pb.LogGroup{Logs: []*pb.Log{makeTestLog("v")}}, "project", "pool"))
+	a.Equal(1, server.received())
+	a.Len(signed, 1)
+	a.NotEmpty(signed[0])
+	a.Equal([]string{"/PutLogs"}, sent)
+
+	// 换成不发出请求的桩
+	a.True(client.Handlers.Send.Swap("test.Send", service.NamedHandler{Name: "test.Stub", Fn: func(r *service.Request) {
+		r.HTTPResponse = &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: http.NoBody}
+	}}))
+	a.NoError(client.PutLogs(&pb.LogGroup{Logs: []*pb.Log{makeTestLog("v")}}, "project", "pool"))
+	a.Equal(1, server.received())
+}
+
+// discardTransport读取并丢弃请求体，总是返回200，用于测量客户端本身的开销。
+type discardTransport struct{}
+
+func (discardTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	_, _ = io.Copy(ioutil.Discard, r.Body)
+	_ = r.Body.Close()
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: r}, nil
+}
+
+func BenchmarkPutLogs(b *testing.B) {
+	lg := &pb.LogGroup{}
+	for i := 0; i < 512; i++ {
+		lg.Logs = append(lg.Logs, makeTestLog(strings.Repeat(fmt.Sprintf("value-%d ", i), 20)))
+	}
+	for _, method := range []string{service.CompressMethodNone, service.CompressMethodLz4, service.CompressMethodGzip, service.CompressMethodZstd} {
+		name := method
+		if name == service.CompressMethodNone {
+			name = "none"
+		}
+		b.Run("compress="+name, func(b *testing.B) {
+			client := New(&service.Config{
+				Credentials: credentials.NewStaticCredentials("AK", "SK", ""),
+				Endpoint:    "127.0.0.1",
+				HTTPClient:  &http.Client{Transport: discardTransport{}},
+			})
+			// Merge不能把CompressMethod设置为空，直接修改
+			client.Config.CompressMethod = method
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := client.PutLogs(lg, "project", "pool"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -16,6 +16,19 @@ var (
 	MaxLogSizeExceeded       = "MaxLogSizeExceeded"
 	InvalidUtf8InKey         = "InvalidUtf8InKey"
 	InvalidUtf8InValue       = "InvalidUtf8InValue"
+
+	// 以下错误码由SDK产生，不会由服务端返回
+	ClientShutdown    = "ClientShutdown"
+	QueueOverflow     = "QueueOverflow"
+	SpoolFull         = "SpoolFull"
+	InvalidOptions    = "InvalidOptions"
+	RetryExhausted    = "RetryExhausted"
+	MaxLogAgeExceeded = "MaxLogAgeExceeded"
+	NoRoute           = "NoRoute"
+	// PutLogsWithContext的ctx结束时返回，同service.CanceledErrorCode
+	RequestCanceled = "RequestCanceled"
+	// 熔断器打开时请求未发送，同service.CircuitOpenErrorCode
+	CircuitOpen = "CircuitOpen"
 )
 
 func IsError(err error, code string) bool {
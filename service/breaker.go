@@ -0,0 +1,272 @@
+package service
+
+import (
+	"github.com/ks3sdk/klog-go-sdk/internal/apierr"
+	"github.com/ks3sdklib/aws-sdk-go/aws/awserr"
+	"sync"
+	"time"
+)
+
+// CircuitOpenErrorCode is the error code of requests refused by an open
+// CircuitBreaker.
+const CircuitOpenErrorCode = "CircuitOpen"
+
+// CircuitState is the state of a CircuitBreaker.
+type CircuitState int
+
+const (
+	// CircuitClosed lets all requests through.
+	CircuitClosed CircuitState = iota
+	// CircuitOpen refuses all requests until the cooldown has passed.
+	CircuitOpen
+	// CircuitHalfOpen lets a limited number of probe requests through. A
+	// successful probe closes the circuit, a failed one opens it again.
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+const (
+	DefaultCircuitConsecutiveFailures = 5
+	DefaultCircuitMinRequests         = 20
+	DefaultCircuitWindow              = 10 * time.Second
+	DefaultCircuitCooldown            = 30 * time.Second
+	DefaultCircuitHalfOpenProbes      = 1
+)
+
+// CircuitBreakerOptions configures a CircuitBreaker. Zero values select the
+// defaults.
+type CircuitBreakerOptions struct {
+	// ConsecutiveFailures opens the circuit after that many failed requests
+	// in a row.
+	ConsecutiveFailures int
+	// FailureRate, between 0 and 1, opens the circuit when the share of
+	// failed requests within Window reaches it, once at least MinRequests
+	// were made. 0 disables the check.
+	FailureRate float64
+	MinRequests int
+	Window      time.Duration
+	// Cooldown is how long the circuit stays open before probing.
+	Cooldown time.Duration
+	// HalfOpenProbes is the number of probe requests let through at once
+	// while half-open.
+	HalfOpenProbes int
+}
+
+// A CircuitBreaker stops sending requests while the service keeps failing, so
+// callers fail fast instead of waiting for timeouts. Request errors and 5xx
+// responses count as failures.
+//
+// Set it as Config.CircuitBreaker, or add it to a Handlers with AddToHandlers.
+// A CircuitBreaker may be shared by several clients.
+type CircuitBreaker struct {
+	options CircuitBreakerOptions
+
+	mu          sync.Mutex
+	state       CircuitState
+	consecutive int
+	windowStart time.Time
+	requests    int
+	failures    int
+	probes      int
+	hooks       map[int]func(from, to CircuitState)
+	nextHook    int
+}
+
+// NewCircuitBreaker returns a closed CircuitBreaker with the given options.
+func NewCircuitBreaker(options CircuitBreakerOptions) *CircuitBreaker {
+	if options.ConsecutiveFailures <= 0 {
+		options.ConsecutiveFailures = DefaultCircuitConsecutiveFailures
+	}
+	if options.MinRequests <= 0 {
+		options.MinRequests = DefaultCircuitMinRequests
+	}
+	if options.Window <= 0 {
+		options.Window = DefaultCircuitWindow
+	}
+	if options.Cooldown <= 0 {
+		options.Cooldown = DefaultCircuitCooldown
+	}
+	if options.HalfOpenProbes <= 0 {
+		options.HalfOpenProbes = DefaultCircuitHalfOpenProbes
+	}
+	return &CircuitBreaker{
+		options: options,
+		hooks:   make(map[int]func(from, to CircuitState)),
+	}
+}
+
+// State returns the current state of the circuit.
+func (b *CircuitBreaker) State() CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// Cooldown returns how long the circuit stays open before probing.
+func (b *CircuitBreaker) Cooldown() time.Duration {
+	return b.options.Cooldown
+}
+
+// OnStateChange registers f to be called after every state change, and
+// returns a function which unregisters it. f may be called concurrently and
+// must not block.
+func (b *CircuitBreaker) OnStateChange(f func(from, to CircuitState)) (cancel func()) {
+	b.mu.Lock()
+	id := b.nextHook
+	b.nextHook++
+	b.hooks[id] = f
+	b.mu.Unlock()
+	return func() {
+		b.mu.Lock()
+		delete(b.hooks, id)
+		b.mu.Unlock()
+	}
+}
+
+// AddToHandlers adds the breaker to the Send phase of h, in front of the
+// other Send handlers.
+func (b *CircuitBreaker) AddToHandlers(h *Handlers) {
+	h.Send.PushFrontNamed(NamedHandler{Name: CircuitBreakerBeforeSendName, Fn: b.beforeSend})
+	h.Send.PushBackNamed(NamedHandler{Name: CircuitBreakerAfterSendName, Fn: b.afterSend})
+}
+
+// beforeSend refuses the request with CircuitOpenErrorCode unless the circuit
+// lets it through.
+func (b *CircuitBreaker) beforeSend(r *Request) {
+	b.mu.Lock()
+	allowed := true
+	switch b.state {
+	case CircuitOpen:
+		allowed = false
+	case CircuitHalfOpen:
+		if b.probes < b.options.HalfOpenProbes {
+			b.probes++
+			r.circuitProbe = true
+		} else {
+			allowed = false
+		}
+	}
+	b.mu.Unlock()
+
+	if !allowed {
+		r.Error = apierr.New(CircuitOpenErrorCode, "the circuit breaker is open, request not sent", nil)
+		r.Retryable.Set(false)
+		return
+	}
+	r.circuit = b
+}
+
+// afterSend records the outcome of a request let through by beforeSend.
+func (b *CircuitBreaker) afterSend(r *Request) {
+	if r.circuit != b {
+		return
+	}
+	probe := r.circuitProbe
+	r.circuit = nil
+	r.circuitProbe = false
+
+	failed := false
+	if r.HTTPResponse != nil {
+		failed = r.HTTPResponse.StatusCode >= 500
+	} else if err, ok := r.Error.(awserr.Error); ok && err.Code() == "RequestError" {
+		failed = true
+	} else {
+		// the request was not sent
+		if probe {
+			b.mu.Lock()
+			b.endProbe()
+			b.mu.Unlock()
+		}
+		return
+	}
+	b.record(probe, failed, time.Now())
+}
+
+func (b *CircuitBreaker) record(probe, failed bool, now time.Time) {
+	b.mu.Lock()
+	from := b.state
+	if probe {
+		b.endProbe()
+		if b.state == CircuitHalfOpen {
+			if failed {
+				b.open()
+			} else {
+				b.close(now)
+			}
+		}
+	} else if b.state == CircuitClosed {
+		// results of requests let through before the circuit opened are
+		// not counted
+		if now.Sub(b.windowStart) > b.options.Window {
+			b.windowStart, b.requests, b.failures = now, 0, 0
+		}
+		b.requests++
+		if failed {
+			b.failures++
+			b.consecutive++
+		} else {
+			b.consecutive = 0
+		}
+		rate := float64(b.failures) / float64(b.requests)
+		if b.consecutive >= b.options.ConsecutiveFailures ||
+			b.options.FailureRate > 0 && b.requests >= b.options.MinRequests && rate >= b.options.FailureRate {
+			b.open()
+		}
+	}
+	b.changed(from)
+}
+
+// endProbe ends a probe request. Probes let through in an earlier half-open
+// period are no longer counted. Called with b.mu held.
+func (b *CircuitBreaker) endProbe() {
+	if b.probes > 0 {
+		b.probes--
+	}
+}
+
+// open opens the circuit and schedules the half-open state. Called with b.mu held.
+func (b *CircuitBreaker) open() {
+	b.state = CircuitOpen
+	time.AfterFunc(b.options.Cooldown, func() {
+		b.mu.Lock()
+		from := b.state
+		if b.state == CircuitOpen {
+			b.state = CircuitHalfOpen
+			b.probes = 0
+		}
+		b.changed(from)
+	})
+}
+
+// close closes the circuit and resets the counters. Called with b.mu held.
+func (b *CircuitBreaker) close(now time.Time) {
+	b.state = CircuitClosed
+	b.consecutive = 0
+	b.windowStart, b.requests, b.failures = now, 0, 0
+}
+
+// changed unlocks b.mu and calls the hooks if the state is no longer from.
+func (b *CircuitBreaker) changed(from CircuitState) {
+	to := b.state
+	var hooks []func(from, to CircuitState)
+	if to != from {
+		for _, f := range b.hooks {
+			hooks = append(hooks, f)
+		}
+	}
+	b.mu.Unlock()
+	for _, f := range hooks {
+		f(from, to)
+	}
+}
@@ -0,0 +1,52 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerFailureRate(t *testing.T) {
+	b := NewCircuitBreaker(CircuitBreakerOptions{
+		ConsecutiveFailures: 100,
+		FailureRate:         0.5,
+		MinRequests:         4,
+		Window:              time.Minute,
+		Cooldown:            time.Minute,
+	})
+	now := time.Now()
+
+	// 请求数不足MinRequests时不熔断
+	b.record(false, true, now)
+	b.record(false, false, now)
+	b.record(false, true, now)
+	assert.Equal(t, CircuitClosed, b.State())
+	b.record(false, false, now)
+	assert.Equal(t, CircuitOpen, b.State())
+}
+
+func TestCircuitBreakerHalfOpenProbes(t *testing.T) {
+	b := NewCircuitBreaker(CircuitBreakerOptions{ConsecutiveFailures: 1, Cooldown: 10 * time.Millisecond})
+	b.record(false, true, time.Now())
+	assert.Equal(t, CircuitOpen, b.State())
+
+	r := &Request{}
+	b.beforeSend(r)
+	assert.Equal(t, CircuitOpenErrorCode, r.Error.(interface{ Code() string }).Code())
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, CircuitHalfOpen, b.State())
+	probe := &Request{}
+	b.beforeSend(probe)
+	assert.Nil(t, probe.Error)
+	assert.True(t, probe.circuitProbe)
+
+	// 同时只放行一个探测请求
+	other := &Request{}
+	b.beforeSend(other)
+	assert.NotNil(t, other.Error)
+
+	// 探测失败后重新熔断
+	b.record(true, true, time.Now())
+	assert.Equal(t, CircuitOpen, b.State())
+}
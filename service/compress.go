@@ -0,0 +1,177 @@
+package service
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"io"
+	"sync"
+)
+
+// A Compressor compresses request bodies for one compress method.
+//
+// Compressors are registered with RegisterCompressor under the value sent in
+// the x-klog-compress-type header, and are selected by Config.CompressMethod.
+// Compress may be called concurrently.
+type Compressor interface {
+	// Compress appends the compressed form of src to dst and returns the
+	// extended buffer. A level of 0 selects the compressor's default level.
+	Compress(dst, src []byte, level int) ([]byte, error)
+}
+
+// CompressorFunc is an adapter to allow the use of ordinary functions as
+// Compressors.
+type CompressorFunc func(dst, src []byte, level int) ([]byte, error)
+
+// Compress calls f(dst, src, level).
+func (f CompressorFunc) Compress(dst, src []byte, level int) ([]byte, error) {
+	return f(dst, src, level)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   = map[string]Compressor{
+		CompressMethodLz4:     CompressorFunc(compressLz4),
+		CompressMethodGzip:    CompressorFunc(compressGzip),
+		CompressMethodDeflate: CompressorFunc(compressDeflate),
+		CompressMethodZstd:    &zstdCompressor{encoders: make(map[zstd.EncoderLevel]*zstd.Encoder)},
+	}
+)
+
+// RegisterCompressor registers c for the compress method name, replacing any
+// compressor previously registered under that name. Services using name as
+// their Config.CompressMethod pick it up on their next request.
+func RegisterCompressor(name string, c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+	compressors[name] = c
+}
+
+// LookupCompressor returns the compressor registered for name.
+func LookupCompressor(name string) (Compressor, bool) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+	c, ok := compressors[name]
+	return c, ok
+}
+
+// A resetWriter is a streaming compressor which can be reused by resetting it
+// to a new destination.
+type resetWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+// writerPool compresses with pooled streaming compressors, one pool per level.
+type writerPool struct {
+	newWriter func(w io.Writer, level int) (resetWriter, error)
+	// level -> *sync.Pool of *pooledWriter
+	pools sync.Map
+}
+
+type pooledWriter struct {
+	out appendWriter
+	z   resetWriter
+}
+
+func (p *writerPool) compress(dst, src []byte, level int) ([]byte, error) {
+	pool, ok := p.pools.Load(level)
+	if !ok {
+		pool, _ = p.pools.LoadOrStore(level, new(sync.Pool))
+	}
+
+	w, _ := pool.(*sync.Pool).Get().(*pooledWriter)
+	if w == nil {
+		w = &pooledWriter{}
+		z, err := p.newWriter(&w.out, level)
+		if err != nil {
+			return nil, err
+		}
+		w.z = z
+	} else {
+		w.z.Reset(&w.out)
+	}
+
+	w.out.buf = dst
+	_, err := w.z.Write(src)
+	if err == nil {
+		err = w.z.Close()
+	}
+	out := w.out.buf
+	w.out.buf = nil
+	pool.(*sync.Pool).Put(w)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+var lz4Writers = &writerPool{
+	newWriter: func(w io.Writer, level int) (resetWriter, error) {
+		z := lz4.NewWriter(w)
+		z.Header.CompressionLevel = level
+		return z, nil
+	},
+}
+
+func compressLz4(dst, src []byte, level int) ([]byte, error) {
+	return lz4Writers.compress(dst, src, level)
+}
+
+var gzipWriters = &writerPool{
+	newWriter: func(w io.Writer, level int) (resetWriter, error) {
+		return gzip.NewWriterLevel(w, level)
+	},
+}
+
+func compressGzip(dst, src []byte, level int) ([]byte, error) {
+	if level == 0 {
+		level = gzip.DefaultCompression
+	}
+	return gzipWriters.compress(dst, src, level)
+}
+
+var zlibWriters = &writerPool{
+	newWriter: func(w io.Writer, level int) (resetWriter, error) {
+		return zlib.NewWriterLevel(w, level)
+	},
+}
+
+// compressDeflate produces the zlib format, as used by the HTTP deflate
+// content coding.
+func compressDeflate(dst, src []byte, level int) ([]byte, error) {
+	if level == 0 {
+		level = zlib.DefaultCompression
+	}
+	return zlibWriters.compress(dst, src, level)
+}
+
+// zstdCompressor keeps one encoder per level, since encoders are expensive to
+// create and EncodeAll may be called concurrently.
+type zstdCompressor struct {
+	mu       sync.Mutex
+	encoders map[zstd.EncoderLevel]*zstd.Encoder
+}
+
+func (c *zstdCompressor) Compress(dst, src []byte, level int) ([]byte, error) {
+	encoderLevel := zstd.SpeedDefault
+	if level != 0 {
+		encoderLevel = zstd.EncoderLevelFromZstd(level)
+	}
+
+	c.mu.Lock()
+	enc, ok := c.encoders[encoderLevel]
+	if !ok {
+		var err error
+		enc, err = zstd.NewWriter(nil, zstd.WithEncoderLevel(encoderLevel))
+		if err != nil {
+			c.mu.Unlock()
+			return nil, err
+		}
+		c.encoders[encoderLevel] = enc
+	}
+	c.mu.Unlock()
+
+	return enc.EncodeAll(src, dst), nil
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestCompressors(t *testing.T) {
+	src := bytes.Repeat([]byte("klog compress test "), 100)
+	readers := map[string]func(r io.Reader) (io.Reader, error){
+		CompressMethodLz4: func(r io.Reader) (io.Reader, error) {
+			return lz4.NewReader(r), nil
+		},
+		CompressMethodGzip: func(r io.Reader) (io.Reader, error) {
+			return gzip.NewReader(r)
+		},
+		CompressMethodDeflate: func(r io.Reader) (io.Reader, error) {
+			return zlib.NewReader(r)
+		},
+		CompressMethodZstd: func(r io.Reader) (io.Reader, error) {
+			return zstd.NewReader(r)
+		},
+	}
+
+	for method, newReader := range readers {
+		for _, level := range []int{0, 1, 9} {
+			c, ok := LookupCompressor(method)
+			if !assert.True(t, ok, method) {
+				continue
+			}
+			compressed, err := c.Compress([]byte("prefix"), src, level)
+			if !assert.NoError(t, err, method) {
+				continue
+			}
+			assert.Equal(t, "prefix", string(compressed[:6]), method)
+			r, err := newReader(bytes.NewReader(compressed[6:]))
+			if !assert.NoError(t, err, method) {
+				continue
+			}
+			decompressed, err := ioutil.ReadAll(r)
+			assert.NoError(t, err, method)
+			assert.Equal(t, src, decompressed, method)
+		}
+	}
+}
+
+func TestCompressHandler(t *testing.T) {
+	RegisterCompressor("reverse", CompressorFunc(func(dst, src []byte, level int) ([]byte, error) {
+		for i := len(src) - 1; i >= 0; i-- {
+			dst = append(dst, src[i])
+		}
+		return dst, nil
+	}))
+	service := NewService(&Config{
+		Endpoint:        "localhost",
+		CompressMethod:  "reverse",
+		CompressMinSize: 4,
+	})
+	op := &Operation{Name: "PutLogs", Method: http.MethodPost, Path: "/PutLogs", Params: &url.Values{}}
+
+	r := NewRequest(service, op, []byte("abcd"))
+	assert.NoError(t, r.Build())
+	body, _ := ioutil.ReadAll(r.Body)
+	assert.Equal(t, "dcba", string(body))
+	assert.Equal(t, "reverse", r.HTTPRequest.Header.Get("x-klog-compress-type"))
+
+	// 小于CompressMinSize时不压缩
+	r = NewRequest(service, op, []byte("abc"))
+	assert.NoError(t, r.Build())
+	body, _ = ioutil.ReadAll(r.Body)
+	assert.Equal(t, "abc", string(body))
+	assert.Equal(t, "", r.HTTPRequest.Header.Get("x-klog-compress-type"))
+}
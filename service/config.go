@@ -3,6 +3,7 @@ package service
 import (
 	"github.com/ks3sdk/klog-go-sdk/credentials"
 	"net/http"
+	"time"
 )
 
 // DefaultChainCredentials is a Credentials which will find the first available
@@ -21,9 +22,12 @@ const (
 	// the service specific retry default will be used.
 	DefaultRetries = -1
 
-	// supported compress methods
-	CompressMethodNone = ""
-	CompressMethodLz4  = "lz4"
+	// supported compress methods, more can be added with RegisterCompressor
+	CompressMethodNone    = ""
+	CompressMethodLz4     = "lz4"
+	CompressMethodGzip    = "gzip"
+	CompressMethodDeflate = "deflate"
+	CompressMethodZstd    = "zstd"
 )
 
 var DefaultConfig = &Config{
@@ -48,6 +52,38 @@ type Config struct {
 	MaxRetries              int
 	DisableComputeChecksums bool
 	CompressMethod          string
+
+	// Endpoints lists fallback endpoints in order of preference. Endpoint, if
+	// set, is the primary and is preferred over all of them. Requests go to the
+	// most preferred healthy endpoint; an endpoint is ejected after
+	// EndpointFailureThreshold consecutive request errors or 5xx responses, and
+	// is probed again with a single request every EndpointEjectDuration.
+	Endpoints                []string
+	EndpointFailureThreshold int
+	EndpointEjectDuration    time.Duration
+
+	// EndpointHealth, if set, tracks the health of the endpoints in place of
+	// EndpointFailureThreshold and EndpointEjectDuration. Configs sharing an
+	// EndpointHealth share which endpoints are ejected.
+	EndpointHealth *EndpointHealth
+
+	// CompressLevel is passed to the compressor, 0 selects its default level.
+	// CompressMinSize is the body size in bytes below which bodies are sent
+	// uncompressed.
+	CompressLevel   int
+	CompressMinSize int
+
+	// Retryer decides which failed requests are retried and the delay before
+	// each retry. Defaults to a DefaultRetryer with MaxRetries retries.
+	Retryer Retryer
+
+	// RateLimiter, if set, limits the requests and bytes sent per second.
+	// Configs sharing a RateLimiter share its limits.
+	RateLimiter *RateLimiter
+
+	// CircuitBreaker, if set, fails requests fast with CircuitOpenErrorCode
+	// while the service keeps failing.
+	CircuitBreaker *CircuitBreaker
 }
 
 // Merge merges the newcfg attribute values into this Config. Each attribute
@@ -116,5 +152,59 @@ func (c Config) Merge(newcfg *Config) *Config {
 		cfg.CompressMethod = c.CompressMethod
 	}
 
+	if len(newcfg.Endpoints) > 0 {
+		cfg.Endpoints = newcfg.Endpoints
+	} else {
+		cfg.Endpoints = c.Endpoints
+	}
+
+	if newcfg.EndpointFailureThreshold > 0 {
+		cfg.EndpointFailureThreshold = newcfg.EndpointFailureThreshold
+	} else {
+		cfg.EndpointFailureThreshold = c.EndpointFailureThreshold
+	}
+
+	if newcfg.EndpointEjectDuration > 0 {
+		cfg.EndpointEjectDuration = newcfg.EndpointEjectDuration
+	} else {
+		cfg.EndpointEjectDuration = c.EndpointEjectDuration
+	}
+
+	if newcfg.EndpointHealth != nil {
+		cfg.EndpointHealth = newcfg.EndpointHealth
+	} else {
+		cfg.EndpointHealth = c.EndpointHealth
+	}
+
+	if newcfg.CompressLevel != 0 {
+		cfg.CompressLevel = newcfg.CompressLevel
+	} else {
+		cfg.CompressLevel = c.CompressLevel
+	}
+
+	if newcfg.CompressMinSize > 0 {
+		cfg.CompressMinSize = newcfg.CompressMinSize
+	} else {
+		cfg.CompressMinSize = c.CompressMinSize
+	}
+
+	if newcfg.Retryer != nil {
+		cfg.Retryer = newcfg.Retryer
+	} else {
+		cfg.Retryer = c.Retryer
+	}
+
+	if newcfg.RateLimiter != nil {
+		cfg.RateLimiter = newcfg.RateLimiter
+	} else {
+		cfg.RateLimiter = c.RateLimiter
+	}
+
+	if newcfg.CircuitBreaker != nil {
+		cfg.CircuitBreaker = newcfg.CircuitBreaker
+	} else {
+		cfg.CircuitBreaker = c.CircuitBreaker
+	}
+
 	return &cfg
 }
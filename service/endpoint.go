@@ -0,0 +1,197 @@
+package service
+
+import (
+	"github.com/ks3sdklib/aws-sdk-go/aws/awserr"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultEndpointFailureThreshold is the number of consecutive failures
+	// after which an endpoint is ejected.
+	DefaultEndpointFailureThreshold = 3
+
+	// DefaultEndpointEjectDuration is how long an ejected endpoint is skipped
+	// before a request is sent to it again to probe whether it has recovered.
+	DefaultEndpointEjectDuration = 30 * time.Second
+)
+
+// EndpointHealthOptions configures an EndpointHealth. Zero values select the
+// defaults.
+type EndpointHealthOptions struct {
+	// FailureThreshold is the number of consecutive failures after which an
+	// endpoint is ejected.
+	FailureThreshold int
+	// EjectDuration is how long an ejected endpoint is skipped before it is
+	// probed again.
+	EjectDuration time.Duration
+}
+
+// An EndpointHealth tracks the health of the endpoints requests are sent to.
+// Health is tracked passively: consecutive request errors and 5xx responses
+// eject an endpoint, and once the eject duration has passed a single request
+// is let through to probe it. A successful probe restores the endpoint, a
+// failed one ejects it again.
+//
+// Set it as Config.EndpointHealth to share the health state between clients,
+// so an endpoint ejected by one client is skipped by all of them. Endpoints are
+// tracked by URL, so clients with different endpoint lists may share it. When
+// Config.EndpointHealth is not set, each service tracks health on its own.
+type EndpointHealth struct {
+	threshold int
+	ejectFor  time.Duration
+
+	mu        sync.Mutex
+	endpoints map[string]*endpoint
+}
+
+// NewEndpointHealth returns an EndpointHealth with the given options.
+func NewEndpointHealth(options EndpointHealthOptions) *EndpointHealth {
+	if options.FailureThreshold <= 0 {
+		options.FailureThreshold = DefaultEndpointFailureThreshold
+	}
+	if options.EjectDuration <= 0 {
+		options.EjectDuration = DefaultEndpointEjectDuration
+	}
+	return &EndpointHealth{
+		threshold: options.FailureThreshold,
+		ejectFor:  options.EjectDuration,
+		endpoints: make(map[string]*endpoint),
+	}
+}
+
+// endpoint returns the entry for u, creating it if needed.
+func (h *EndpointHealth) endpoint(u *url.URL) *endpoint {
+	key := u.Scheme + "://" + u.Host
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e, ok := h.endpoints[key]
+	if !ok {
+		e = &endpoint{url: u}
+		h.endpoints[key] = e
+	}
+	return e
+}
+
+// An endpointSet is the endpoints a service can send requests to, in order of
+// preference, with their health tracked by an EndpointHealth.
+type endpointSet struct {
+	health    *EndpointHealth
+	endpoints []*endpoint
+}
+
+// An endpoint is a single entry in the EndpointHealth.
+type endpoint struct {
+	url *url.URL
+
+	// guarded by EndpointHealth.mu
+	failures     int
+	ejectedUntil time.Time
+	probing      bool
+}
+
+// newEndpointSet returns an endpointSet for the given endpoints in order of
+// preference, or nil if there is nothing to fail over to.
+func newEndpointSet(endpoints []string, health *EndpointHealth) *endpointSet {
+	if len(endpoints) < 2 {
+		return nil
+	}
+	s := &endpointSet{health: health}
+	for _, e := range endpoints {
+		u, err := url.Parse(e)
+		if err != nil {
+			continue
+		}
+		s.endpoints = append(s.endpoints, health.endpoint(u))
+	}
+	return s
+}
+
+// pick returns the most preferred endpoint which is healthy or due for a probe.
+// The endpoint the request last failed on is avoided if another one is usable.
+// If every endpoint is ejected the one which recovers first is returned, so
+// requests are never refused outright.
+func (s *endpointSet) pick(last *endpoint, now time.Time) *endpoint {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+
+	var fallback, earliest *endpoint
+	for _, e := range s.endpoints {
+		if e.failures >= s.health.threshold {
+			if earliest == nil || e.ejectedUntil.Before(earliest.ejectedUntil) {
+				earliest = e
+			}
+			if e.probing || now.Before(e.ejectedUntil) {
+				continue
+			}
+			e.probing = true
+			return e
+		}
+		if e == last {
+			fallback = e
+			continue
+		}
+		return e
+	}
+	if fallback != nil {
+		return fallback
+	}
+	return earliest
+}
+
+// report records the outcome of a request sent to e.
+func (s *endpointSet) report(e *endpoint, ok bool, now time.Time) {
+	s.health.mu.Lock()
+	defer s.health.mu.Unlock()
+
+	e.probing = false
+	if ok {
+		e.failures = 0
+		return
+	}
+	e.failures++
+	if e.failures >= s.health.threshold {
+		e.ejectedUntil = now.Add(s.health.ejectFor)
+	}
+}
+
+// release lets another request probe e if this one did not reach it.
+func (s *endpointSet) release(e *endpoint) {
+	s.health.mu.Lock()
+	e.probing = false
+	s.health.mu.Unlock()
+}
+
+// SelectEndpointHandler is a request handler which points the request at the
+// most preferred healthy endpoint when more than one endpoint is configured.
+// It does nothing if an earlier Send handler already failed the request.
+func SelectEndpointHandler(r *Request) {
+	if r.Service.endpoints == nil || r.Error != nil {
+		return
+	}
+	e := r.Service.endpoints.pick(r.endpoint, time.Now())
+	r.endpoint = e
+	r.HTTPRequest.URL.Scheme = e.url.Scheme
+	r.HTTPRequest.URL.Host = e.url.Host
+	r.HTTPRequest.Host = ""
+	r.HTTPRequest.Header.Set("klog-Host", e.url.Scheme+"://"+e.url.Host)
+}
+
+// EndpointHealthHandler is a request handler which records whether the
+// endpoint chosen by SelectEndpointHandler served the request. Request errors
+// and 5xx responses count as failures.
+func EndpointHealthHandler(r *Request) {
+	if r.Service.endpoints == nil || r.endpoint == nil {
+		return
+	}
+	var ok bool
+	if r.HTTPResponse != nil {
+		ok = r.HTTPResponse.StatusCode < 500
+	} else if err, isErr := r.Error.(awserr.Error); !isErr || err.Code() != "RequestError" {
+		// the request was not sent, so there is nothing to learn about the endpoint
+		r.Service.endpoints.release(r.endpoint)
+		return
+	}
+	r.Service.endpoints.report(r.endpoint, ok, time.Now())
+}
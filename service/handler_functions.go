@@ -2,13 +2,13 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/ks3sdk/klog-go-sdk/internal/apierr"
 	"github.com/ks3sdklib/aws-sdk-go/aws/awserr"
-	"github.com/pierrec/lz4"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -18,6 +18,13 @@ import (
 	"time"
 )
 
+const (
+	// CanceledErrorCode is the error code that will be returned by an
+	// API request that was canceled. Requests given a context may
+	// return this error when canceled.
+	CanceledErrorCode = "RequestCanceled"
+)
+
 var (
 	// ErrMissingEndpoint is an error that is returned if an endpoint cannot be
 	// resolved for a service.
@@ -48,27 +55,53 @@ func CommonHeaderHandler(r *Request) {
 	r.HTTPRequest.Header.Set("x-klog-signature-method", "hmac-sha1")
 }
 
+// CompressHandler compresses the request body with the Compressor registered
+// for Config.CompressMethod. Bodies smaller than Config.CompressMinSize are
+// sent uncompressed.
+func CompressHandler(r *Request) {
+	method := r.Config.CompressMethod
+	if method == CompressMethodNone || len(r.data) < r.Config.CompressMinSize {
+		return
+	}
+	compress(r, method)
+}
+
+// CompressLz4 compresses the request body with lz4, whatever the
+// Config.CompressMethod is.
 func CompressLz4(r *Request) {
-	dst := new(bytes.Buffer)
-	z := lz4.NewWriter(dst)
-	_, err := z.Write(r.data)
-	if err != nil {
-		r.Error = apierr.New("CompressLz4", "failed to write", err)
+	compress(r, CompressMethodLz4)
+}
+
+func compress(r *Request, method string) {
+	c, ok := LookupCompressor(method)
+	if !ok {
+		r.Error = apierr.New("Compress", fmt.Sprintf("unknown compress method %q", method), nil)
 		return
 	}
-	err = z.Close()
+	buf := GetBuffer()
+	compressed, err := c.Compress(*buf, r.data, r.Config.CompressLevel)
 	if err != nil {
-		r.Error = apierr.New("CompressLz4", "failed to close", err)
+		PutBuffer(buf)
+		r.Error = apierr.New("Compress", "failed to compress with "+method, err)
 		return
 	}
-
-	compressed := dst.Bytes()
+	*buf = compressed
+	r.OnRelease(func() {
+		PutBuffer(buf)
+	})
 
 	r.SetBufferBody(compressed)
-	r.HTTPRequest.Header.Set("x-klog-compress-type", "lz4")
+	r.HTTPRequest.Header.Set("x-klog-compress-type", method)
 }
 
 func ContentMD5(r *Request) {
+	if r.bodyBytes != nil {
+		// the body is in memory, hash it without reading through the reader.
+		sum := md5.Sum(r.bodyBytes)
+		r.HTTPRequest.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		return
+	}
+
 	h := md5.New()
 
 	// hash the body.  seek back to the first position after reading to reset
@@ -92,8 +125,17 @@ func ContentMD5(r *Request) {
 	r.HTTPRequest.Header.Set("Content-MD5", string(sum64))
 }
 
-var sleepDelay = func(delay time.Duration) {
-	time.Sleep(delay)
+// sleepDelay waits for delay, returning early with the context's error if
+// ctx is done first.
+var sleepDelay = func(ctx context.Context, delay time.Duration) error {
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // Interface for matching types which also have a Len method.
@@ -134,10 +176,17 @@ var reStatusCode = regexp.MustCompile(`^(\d+)`)
 
 // SendHandler is a request handler to send service request using HTTP client.
 func SendHandler(r *Request) {
+	if r.Error != nil {
+		// an earlier Send handler, such as RateLimitHandler, failed the request
+		r.HTTPResponse = nil
+		return
+	}
 
 	var err error
 	if r.HTTPRequest.ContentLength <= 0 {
 		r.HTTPRequest.Body = http.NoBody
+	} else if body, ok := r.HTTPRequest.Body.(*requestBody); ok {
+		body.send()
 	}
 	r.HTTPResponse, err = r.Service.Config.HTTPClient.Do(r.HTTPRequest)
 	if err != nil {
@@ -156,6 +205,13 @@ func SendHandler(r *Request) {
 				return
 			}
 		}
+		// A request which failed because its context is done must not be
+		// retried.
+		if ctxErr := r.Context().Err(); ctxErr != nil {
+			r.Error = apierr.New(CanceledErrorCode, "request context canceled", ctxErr)
+			r.Retryable.Set(false)
+			return
+		}
 		// Catch all other request errors.
 		r.Error = apierr.New("RequestError", "send request failed", err)
 		r.Retryable.Set(true) // network errors are retryable
@@ -173,7 +229,10 @@ func AfterRetryHandler(r *Request) {
 
 	if r.WillRetry() {
 		r.RetryDelay = r.Service.RetryRules(r)
-		sleepDelay(r.RetryDelay)
+		if err := sleepDelay(r.Context(), r.RetryDelay); err != nil {
+			r.Error = apierr.New(CanceledErrorCode, "request context canceled", err)
+			return
+		}
 
 		// when the expired token exception occurs the credentials
 		// need to be expired locally so that the next request to
@@ -187,6 +246,7 @@ func AfterRetryHandler(r *Request) {
 		}
 
 		r.RetryCount++
+		r.RetryErrors = append(r.RetryErrors, r.Error)
 		r.Error = nil
 	}
 }
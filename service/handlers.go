@@ -13,15 +13,63 @@ type Handlers struct {
 	AfterRetry       HandlerList
 }
 
+// Names of the built-in handlers, for use with HandlerList.Remove,
+// InsertBefore, InsertAfter and Swap.
+const (
+	ValidateEndpointHandlerName  = "core.ValidateEndpointHandler"
+	UserAgentHandlerName         = "core.UserAgentHandler"
+	RequestIdHandlerName         = "core.RequestIdHandler"
+	CommonHeaderHandlerName      = "core.CommonHeaderHandler"
+	CompressHandlerName          = "core.CompressHandler"
+	ContentMD5HandlerName        = "core.ContentMD5"
+	BuildContentLengthName       = "core.BuildContentLength"
+	RateLimitHandlerName         = "core.RateLimitHandler"
+	SelectEndpointHandlerName    = "core.SelectEndpointHandler"
+	SendHandlerName              = "core.SendHandler"
+	EndpointHealthHandlerName    = "core.EndpointHealthHandler"
+	CircuitBreakerBeforeSendName = "core.CircuitBreakerBeforeSend"
+	CircuitBreakerAfterSendName  = "core.CircuitBreakerAfterSend"
+	AfterRetryHandlerName        = "core.AfterRetryHandler"
+	ValidateResponseHandlerName  = "core.ValidateResponseHandler"
+	DebugRequestHandlerName      = "core.DebugRequestHandler"
+	DebugResponseHandlerName     = "core.DebugResponseHandler"
+)
+
+// A NamedHandler is a handler registered under a name, so it can be found
+// again in a HandlerList. Handlers added with PushBack and PushFront have an
+// empty name.
+type NamedHandler struct {
+	Name string
+	Fn   func(*Request)
+}
+
+// A HandlerListRunItem is the handler which has just run, passed to
+// HandlerList.AfterEachFn.
+type HandlerListRunItem struct {
+	Index   int
+	Handler NamedHandler
+	Request *Request
+}
+
 // A HandlerList manages zero or more handlers in a list.
 type HandlerList struct {
-	list []func(*Request)
+	list []NamedHandler
+
+	// AfterEachFn is called after each handler has run. Returning false
+	// stops the list, the remaining handlers of the phase are not run.
+	AfterEachFn func(item HandlerListRunItem) bool
+}
+
+// HandlerListStopOnError is an AfterEachFn which stops the list once a
+// handler has set r.Error.
+func HandlerListStopOnError(item HandlerListRunItem) bool {
+	return item.Request.Error == nil
 }
 
 // copy creates a copy of the handler list.
 func (l *HandlerList) copy() HandlerList {
-	var n HandlerList
-	n.list = append([]func(*Request){}, l.list...)
+	n := HandlerList{AfterEachFn: l.AfterEachFn}
+	n.list = append([]NamedHandler{}, l.list...)
 	return n
 }
 
@@ -57,7 +105,7 @@ func (h *Handlers) Clear() {
 
 // Clear clears the handler list.
 func (l *HandlerList) Clear() {
-	l.list = []func(*Request){}
+	l.list = []NamedHandler{}
 }
 
 // Len returns the number of handlers in the list.
@@ -65,19 +113,113 @@ func (l *HandlerList) Len() int {
 	return len(l.list)
 }
 
+// Names returns the names of the handlers in the list, in the order they run.
+func (l *HandlerList) Names() []string {
+	names := make([]string, len(l.list))
+	for i, h := range l.list {
+		names[i] = h.Name
+	}
+	return names
+}
+
 // PushBack pushes handlers f to the back of the handler list.
 func (l *HandlerList) PushBack(f ...func(*Request)) {
-	l.list = append(l.list, f...)
+	for _, fn := range f {
+		l.list = append(l.list, NamedHandler{Fn: fn})
+	}
 }
 
 // PushFront pushes handlers f to the front of the handler list.
 func (l *HandlerList) PushFront(f ...func(*Request)) {
-	l.list = append(f, l.list...)
+	named := make([]NamedHandler, len(f))
+	for i, fn := range f {
+		named[i] = NamedHandler{Fn: fn}
+	}
+	l.list = append(named, l.list...)
+}
+
+// PushBackNamed pushes named handler n to the back of the handler list.
+func (l *HandlerList) PushBackNamed(n NamedHandler) {
+	l.list = append(l.list, n)
+}
+
+// PushFrontNamed pushes named handler n to the front of the handler list.
+func (l *HandlerList) PushFrontNamed(n NamedHandler) {
+	l.list = append([]NamedHandler{n}, l.list...)
+}
+
+// Remove removes all handlers with the given name, and returns how many were
+// removed.
+func (l *HandlerList) Remove(name string) int {
+	list := make([]NamedHandler, 0, len(l.list))
+	for _, h := range l.list {
+		if h.Name != name {
+			list = append(list, h)
+		}
+	}
+	removed := len(l.list) - len(list)
+	l.list = list
+	return removed
+}
+
+// InsertBefore inserts n in front of the first handler with the given name.
+// It returns false, leaving the list unchanged, if there is no such handler.
+func (l *HandlerList) InsertBefore(name string, n NamedHandler) bool {
+	i := l.index(name)
+	if i < 0 {
+		return false
+	}
+	l.insert(i, n)
+	return true
+}
+
+// InsertAfter inserts n after the first handler with the given name. It
+// returns false, leaving the list unchanged, if there is no such handler.
+func (l *HandlerList) InsertAfter(name string, n NamedHandler) bool {
+	i := l.index(name)
+	if i < 0 {
+		return false
+	}
+	l.insert(i+1, n)
+	return true
+}
+
+// Swap replaces all handlers with the given name by n, in place, and returns
+// if any was replaced.
+func (l *HandlerList) Swap(name string, n NamedHandler) bool {
+	swapped := false
+	for i, h := range l.list {
+		if h.Name == name {
+			l.list[i] = n
+			swapped = true
+		}
+	}
+	return swapped
+}
+
+func (l *HandlerList) index(name string) int {
+	for i, h := range l.list {
+		if h.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l *HandlerList) insert(i int, n NamedHandler) {
+	list := make([]NamedHandler, 0, len(l.list)+1)
+	list = append(list, l.list[:i]...)
+	list = append(list, n)
+	l.list = append(list, l.list[i:]...)
 }
 
-// Run executes all handlers in the list with a given request object.
+// Run executes all handlers in the list with a given request object, until
+// AfterEachFn, if set, returns false.
 func (l *HandlerList) Run(r *Request) {
-	for _, f := range l.list {
-		f(r)
+	for i, h := range l.list {
+		h.Fn(r)
+		if l.AfterEachFn != nil && !l.AfterEachFn(HandlerListRunItem{Index: i, Handler: h, Request: r}) {
+			return
+		}
 	}
 }
@@ -0,0 +1,70 @@
+package service
+
+import (
+	"github.com/ks3sdk/klog-go-sdk/internal/apierr"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHandlerListNamed(t *testing.T) {
+	var calls []string
+	named := func(name string) NamedHandler {
+		return NamedHandler{Name: name, Fn: func(r *Request) {
+			calls = append(calls, name)
+		}}
+	}
+
+	var l HandlerList
+	l.PushBackNamed(named("b"))
+	l.PushFrontNamed(named("a"))
+	l.PushBackNamed(named("d"))
+	assert.True(t, l.InsertAfter("b", named("c")))
+	assert.True(t, l.InsertBefore("a", named("first")))
+	assert.False(t, l.InsertAfter("missing", named("x")))
+	assert.Equal(t, []string{"first", "a", "b", "c", "d"}, l.Names())
+
+	assert.True(t, l.Swap("c", named("c2")))
+	assert.False(t, l.Swap("missing", named("x")))
+	assert.Equal(t, 1, l.Remove("first"))
+	assert.Equal(t, 0, l.Remove("missing"))
+
+	l.Run(&Request{})
+	assert.Equal(t, []string{"a", "b", "c2", "d"}, calls)
+}
+
+func TestHandlerListCopyIsIndependent(t *testing.T) {
+	var l HandlerList
+	l.PushBackNamed(NamedHandler{Name: "a", Fn: func(*Request) {}})
+	l.PushBackNamed(NamedHandler{Name: "b", Fn: func(*Request) {}})
+
+	n := l.copy()
+	n.Swap("a", NamedHandler{Name: "x", Fn: func(*Request) {}})
+	n.InsertAfter("b", NamedHandler{Name: "c", Fn: func(*Request) {}})
+	assert.Equal(t, []string{"a", "b"}, l.Names())
+	assert.Equal(t, []string{"x", "b", "c"}, n.Names())
+}
+
+func TestHandlerListStopOnError(t *testing.T) {
+	ran := 0
+	var l HandlerList
+	l.AfterEachFn = HandlerListStopOnError
+	l.PushBack(func(r *Request) {
+		ran++
+		r.Error = apierr.New("Failed", "failed", nil)
+	})
+	l.PushBack(func(r *Request) {
+		ran++
+	})
+
+	n := l.copy()
+	n.Run(&Request{})
+	assert.Equal(t, 1, ran)
+}
+
+func TestServiceHandlerNames(t *testing.T) {
+	service := NewService(&Config{Endpoint: "localhost", Endpoints: []string{"fallback"}, CompressMethod: CompressMethodLz4, CircuitBreaker: NewCircuitBreaker(CircuitBreakerOptions{})})
+	assert.Equal(t, []string{UserAgentHandlerName, RequestIdHandlerName, CommonHeaderHandlerName, CompressHandlerName, ContentMD5HandlerName},
+		service.Handlers.Build.Names())
+	assert.Equal(t, []string{CircuitBreakerBeforeSendName, RateLimitHandlerName, SelectEndpointHandlerName, SendHandlerName, EndpointHealthHandlerName, CircuitBreakerAfterSendName},
+		service.Handlers.Send.Names())
+}
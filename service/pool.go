@@ -0,0 +1,42 @@
+package service
+
+import (
+	"sync"
+)
+
+// maxPooledBufferSize is the capacity above which buffers are not returned to
+// the pool, so that a single huge request does not pin its memory.
+const maxPooledBufferSize = 8 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+// GetBuffer returns an empty byte slice from a pool shared by all services.
+// The slice should be handed back with PutBuffer once nothing references it.
+func GetBuffer() *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	*buf = (*buf)[:0]
+	return buf
+}
+
+// PutBuffer returns buf to the pool. buf must not be used afterwards.
+func PutBuffer(buf *[]byte) {
+	if buf == nil || cap(*buf) > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// appendWriter is an io.Writer appending to a byte slice, used to let
+// streaming compressors write into pooled buffers.
+type appendWriter struct {
+	buf []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
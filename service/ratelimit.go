@@ -0,0 +1,171 @@
+package service
+
+import (
+	"context"
+	"github.com/ks3sdk/klog-go-sdk/internal/apierr"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimiterOptions configures a RateLimiter. A zero rate does not limit.
+type RateLimiterOptions struct {
+	// RequestsPerSecond limits the number of requests sent per second.
+	RequestsPerSecond float64
+	// RequestBurst is the number of requests which may be sent at once,
+	// defaults to RequestsPerSecond rounded up.
+	RequestBurst int
+	// BytesPerSecond limits the request body bytes sent per second, counted
+	// after compression.
+	BytesPerSecond float64
+	// ByteBurst is the number of bytes which may be sent at once, defaults to
+	// one second's worth of BytesPerSecond. A request larger than ByteBurst is
+	// still sent, after waiting for the bytes it exceeds the burst by.
+	ByteBurst int
+}
+
+// RateLimiterStats are the counters of a RateLimiter.
+type RateLimiterStats struct {
+	// Requests is the number of requests let through.
+	Requests int64
+	// Bytes is the number of body bytes let through.
+	Bytes int64
+	// Delayed is the number of requests which had to wait.
+	Delayed int64
+	// Canceled is the number of requests whose context was done while waiting.
+	Canceled int64
+	// WaitTime is the total time requests waited, MaxWait the longest wait.
+	WaitTime time.Duration
+	MaxWait  time.Duration
+}
+
+// A RateLimiter is a token bucket limiting the requests and bytes sent per
+// second. It is applied in the Send phase when set as Config.RateLimiter, and
+// may be shared by several clients by giving them the same RateLimiter.
+type RateLimiter struct {
+	mu       sync.Mutex
+	requests *tokenBucket
+	bytes    *tokenBucket
+	stats    RateLimiterStats
+}
+
+// NewRateLimiter returns a RateLimiter with the given options.
+func NewRateLimiter(options RateLimiterOptions) *RateLimiter {
+	l := &RateLimiter{}
+	if options.RequestsPerSecond > 0 {
+		burst := float64(options.RequestBurst)
+		if burst <= 0 {
+			burst = math.Ceil(options.RequestsPerSecond)
+		}
+		l.requests = newTokenBucket(options.RequestsPerSecond, burst)
+	}
+	if options.BytesPerSecond > 0 {
+		burst := float64(options.ByteBurst)
+		if burst <= 0 {
+			burst = math.Ceil(options.BytesPerSecond)
+		}
+		l.bytes = newTokenBucket(options.BytesPerSecond, burst)
+	}
+	return l
+}
+
+// Wait blocks until a request of n body bytes may be sent, or ctx is done.
+func (l *RateLimiter) Wait(ctx context.Context, n int64) error {
+	now := time.Now()
+	l.mu.Lock()
+	delay := l.requests.reserve(1, now)
+	if d := l.bytes.reserve(float64(n), now); d > delay {
+		delay = d
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			// give back the tokens, later requests need not wait for them
+			l.mu.Lock()
+			l.requests.cancel(1)
+			l.bytes.cancel(float64(n))
+			l.stats.Canceled++
+			l.stats.WaitTime += time.Now().Sub(now)
+			l.mu.Unlock()
+			return ctx.Err()
+		}
+	}
+
+	l.mu.Lock()
+	l.stats.Requests++
+	l.stats.Bytes += n
+	if delay > 0 {
+		l.stats.Delayed++
+		l.stats.WaitTime += delay
+		if delay > l.stats.MaxWait {
+			l.stats.MaxWait = delay
+		}
+	}
+	l.mu.Unlock()
+	return nil
+}
+
+// Stats returns the counters of the limiter.
+func (l *RateLimiter) Stats() RateLimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
+
+// tokenBucket refills at rate tokens per second up to burst. Tokens are
+// reserved ahead, so the count goes negative while requests wait for them.
+// A nil tokenBucket does not limit. Guarded by RateLimiter.mu.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// reserve takes n tokens and returns how long until they are available.
+func (b *tokenBucket) reserve(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	if now.After(b.last) {
+		b.tokens = math.Min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+		b.last = now
+	}
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// cancel returns n reserved tokens.
+func (b *tokenBucket) cancel(n float64) {
+	if b == nil {
+		return
+	}
+	b.tokens = math.Min(b.burst, b.tokens+n)
+}
+
+// RateLimitHandler is a request handler which waits for the Config.RateLimiter
+// before the request is sent. The request fails with CanceledErrorCode if its
+// context is done while waiting. A request already failed by an earlier Send
+// handler, such as an open circuit breaker, does not wait or consume tokens.
+func RateLimitHandler(r *Request) {
+	limiter := r.Config.RateLimiter
+	if limiter == nil || r.Error != nil {
+		return
+	}
+	if err := limiter.Wait(r.Context(), r.HTTPRequest.ContentLength); err != nil {
+		r.Error = apierr.New(CanceledErrorCode, "request context canceled while rate limited", err)
+		r.Retryable.Set(false)
+	}
+}
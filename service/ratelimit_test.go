@@ -0,0 +1,42 @@
+package service
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRequests(t *testing.T) {
+	l := NewRateLimiter(RateLimiterOptions{RequestsPerSecond: 20, RequestBurst: 1})
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		assert.NoError(t, l.Wait(context.Background(), 0))
+	}
+	// 第一个请求不等待，之后每个等待50ms
+	assert.True(t, time.Now().Sub(start) >= 180*time.Millisecond)
+
+	stats := l.Stats()
+	assert.Equal(t, int64(5), stats.Requests)
+	assert.Equal(t, int64(4), stats.Delayed)
+	assert.True(t, stats.WaitTime >= 180*time.Millisecond)
+	assert.True(t, stats.MaxWait > 0)
+}
+
+func TestRateLimiterBytes(t *testing.T) {
+	l := NewRateLimiter(RateLimiterOptions{BytesPerSecond: 1000})
+	assert.NoError(t, l.Wait(context.Background(), 1000))
+
+	// 超过的字节数需要等待，ctx结束时放弃并归还
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, l.Wait(ctx, 1000))
+	stats := l.Stats()
+	assert.Equal(t, int64(1), stats.Requests)
+	assert.Equal(t, int64(1000), stats.Bytes)
+	assert.Equal(t, int64(1), stats.Canceled)
+
+	start := time.Now()
+	assert.NoError(t, l.Wait(context.Background(), 100))
+	assert.True(t, time.Now().Sub(start) < 200*time.Millisecond)
+}
@@ -2,11 +2,12 @@ package service
 
 import (
 	"bytes"
+	"context"
 	"io"
-	"io/ioutil"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -28,8 +29,22 @@ type Request struct {
 	Retryable    SettableBool
 	RetryDelay   time.Duration
 
+	// RetryErrors are the errors of the attempts which were retried, so
+	// handlers of a retry can see why the earlier attempts failed.
+	RetryErrors []error
+
 	data  []byte
 	built bool
+	ctx   context.Context
+	// the body bytes when the body was set by SetBufferBody
+	bodyBytes []byte
+	// called by Release once the body is no longer read
+	releases []func()
+	// the circuit breaker which let the request through, and if as a probe
+	circuit      *CircuitBreaker
+	circuitProbe bool
+	// the endpoint the request was last sent to, when failing over between endpoints
+	endpoint *endpoint
 }
 
 // NewRequest returns a new Request pointer for the service API
@@ -57,16 +72,119 @@ func NewRequest(service *Service, op *Operation, inputs []byte) *Request {
 	return r
 }
 
+// SetContext sets the context of the request. The context is attached to the
+// outgoing HTTP request, and a canceled context also ends any delay before a
+// retry. The request fails with CanceledErrorCode once the context is done.
+//
+// SetContext must be called before Send. A nil context will panic.
+func (r *Request) SetContext(ctx context.Context) {
+	if ctx == nil {
+		panic("context cannot be nil")
+	}
+	r.ctx = ctx
+	r.HTTPRequest = r.HTTPRequest.WithContext(ctx)
+}
+
+// Context returns the context of the request, context.Background() if
+// none was set.
+func (r *Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+	return context.Background()
+}
+
 // SetBufferBody will set the request's body bytes that will be sent to
 // the service API.
 func (r *Request) SetBufferBody(buf []byte) {
 	r.SetReaderBody(bytes.NewReader(buf))
+	r.bodyBytes = buf
 }
 
 // SetReaderBody will set the request's body reader.
 func (r *Request) SetReaderBody(reader io.ReadSeeker) {
-	r.HTTPRequest.Body = ioutil.NopCloser(reader)
+	r.HTTPRequest.Body = &requestBody{ReadSeeker: reader}
 	r.Body = reader
+	r.bodyBytes = nil
+}
+
+// OnRelease registers f to be called by Release, once the HTTP client no
+// longer reads the request body. It is used to give buffers backing the body
+// back to a pool.
+func (r *Request) OnRelease(f func()) {
+	r.releases = append(r.releases, f)
+}
+
+// Release runs the functions registered with OnRelease, so buffers holding
+// the request body, such as the compressed body, can be reused by later
+// requests. The request must not be sent again after Release. Requests which
+// are not released are garbage collected as usual.
+//
+// A transport may still read the body after it returned the response. In that
+// case the functions run when the transport closes the body.
+func (r *Request) Release() {
+	releases := r.releases
+	r.releases = nil
+	r.bodyBytes = nil
+	release := func() {
+		for _, f := range releases {
+			f()
+		}
+	}
+	if body, ok := r.HTTPRequest.Body.(*requestBody); ok {
+		body.release(release)
+		return
+	}
+	release()
+}
+
+// requestBody is the body of the HTTP request. It counts the round trips which
+// may still read it, so the buffers behind it are not reused too early.
+// Closing it does not close the underlying reader, since the body is sent again
+// on retries.
+type requestBody struct {
+	io.ReadSeeker
+
+	mu        sync.Mutex
+	reading   int
+	onRelease func()
+}
+
+// send is called before the body is given to the HTTP client, which closes it
+// when done.
+func (b *requestBody) send() {
+	b.mu.Lock()
+	b.reading++
+	b.mu.Unlock()
+}
+
+func (b *requestBody) Close() error {
+	b.mu.Lock()
+	var f func()
+	if b.reading > 0 {
+		b.reading--
+		if b.reading == 0 {
+			f, b.onRelease = b.onRelease, nil
+		}
+	}
+	b.mu.Unlock()
+	if f != nil {
+		f()
+	}
+	return nil
+}
+
+// release calls f now, or when the last round trip closes the body.
+func (b *requestBody) release(f func()) {
+	b.mu.Lock()
+	if b.reading > 0 {
+		b.onRelease = f
+		f = nil
+	}
+	b.mu.Unlock()
+	if f != nil {
+		f()
+	}
 }
 
 // SetStringBody sets the body of the request to be backed by a string.
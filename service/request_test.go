@@ -0,0 +1,34 @@
+package service
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRequestReleaseWaitsForBody(t *testing.T) {
+	service := NewService(&Config{Endpoint: "localhost"})
+	op := &Operation{Name: "PutLogs", Method: http.MethodPost, Path: "/PutLogs", Params: &url.Values{}}
+	r := NewRequest(service, op, []byte("body"))
+	released := 0
+	r.OnRelease(func() {
+		released++
+	})
+
+	// 模拟返回响应后仍在读取请求体的transport
+	body := r.HTTPRequest.Body.(*requestBody)
+	body.send()
+	r.Release()
+	assert.Equal(t, 0, released)
+	assert.NoError(t, body.Close())
+	assert.Equal(t, 1, released)
+
+	// 没有正在进行的请求时立即调用
+	r = NewRequest(service, op, []byte("body"))
+	r.OnRelease(func() {
+		released++
+	})
+	r.Release()
+	assert.Equal(t, 2, released)
+}
@@ -0,0 +1,121 @@
+package service
+
+import (
+	"github.com/ks3sdklib/aws-sdk-go/aws/awserr"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A Retryer decides whether a failed request is retried and how long to wait
+// before the retry. Set Config.Retryer to replace the DefaultRetryer.
+type Retryer interface {
+	// MaxRetries returns the number of retries made after the first attempt.
+	MaxRetries() int
+	// ShouldRetry returns if the request, which failed with r.Error, should
+	// be retried.
+	ShouldRetry(r *Request) bool
+	// RetryDelay returns how long to wait before retrying the request.
+	// r.RetryCount is the number of retries made so far.
+	RetryDelay(r *Request) time.Duration
+}
+
+const (
+	// DefaultRetryerMaxRetries is the number of retries used when neither
+	// DefaultRetryer.NumMaxRetries nor Config.MaxRetries is set.
+	DefaultRetryerMaxRetries = 3
+	// DefaultRetryerMinDelay is the base of the exponential backoff.
+	DefaultRetryerMinDelay = 30 * time.Millisecond
+	// DefaultRetryerMaxDelay caps the backoff and any Retry-After delay.
+	DefaultRetryerMaxDelay = 5 * time.Second
+)
+
+// DefaultRetryer retries request errors, throttling, 5xx responses and the
+// retryable KLog error codes, with full-jitter exponential backoff: the n-th
+// retry waits a random time in [0, min(MaxDelay, MinDelay * 2^n)]. A
+// Retry-After header on the response, in seconds or as an HTTP date, is used
+// instead, capped at MaxDelay.
+type DefaultRetryer struct {
+	// NumMaxRetries is the number of retries, DefaultRetries selects
+	// DefaultRetryerMaxRetries.
+	NumMaxRetries int
+	// MinDelay defaults to DefaultRetryerMinDelay.
+	MinDelay time.Duration
+	// MaxDelay defaults to DefaultRetryerMaxDelay.
+	MaxDelay time.Duration
+}
+
+// MaxRetries returns the number of retries after the first attempt.
+func (d DefaultRetryer) MaxRetries() int {
+	if d.NumMaxRetries < 0 {
+		return DefaultRetryerMaxRetries
+	}
+	return d.NumMaxRetries
+}
+
+// ShouldRetry returns if the request should be retried.
+func (d DefaultRetryer) ShouldRetry(r *Request) bool {
+	if err, ok := r.Error.(awserr.Error); ok {
+		if err.Code() == CanceledErrorCode {
+			return false
+		}
+		if isCodeRetryable(err.Code()) {
+			return true
+		}
+	}
+	if r.HTTPResponse != nil {
+		return r.HTTPResponse.StatusCode >= 500 || r.HTTPResponse.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// RetryDelay returns the delay before the next retry of the request.
+func (d DefaultRetryer) RetryDelay(r *Request) time.Duration {
+	minDelay := d.MinDelay
+	if minDelay <= 0 {
+		minDelay = DefaultRetryerMinDelay
+	}
+	maxDelay := d.MaxDelay
+	if maxDelay <= 0 {
+		maxDelay = DefaultRetryerMaxDelay
+	}
+
+	if delay, ok := retryAfter(r, time.Now()); ok {
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+		return delay
+	}
+
+	ceiling := maxDelay
+	if r.RetryCount < 32 && minDelay <= maxDelay>>r.RetryCount {
+		ceiling = minDelay << r.RetryCount
+	}
+	// draw in int64, the delay in nanoseconds overflows int on 32-bit platforms
+	return time.Duration(MakeRandomInt64(int64(ceiling) + 1))
+}
+
+// retryAfter returns the delay requested by the Retry-After header of the
+// response, if any.
+func retryAfter(r *Request, now time.Time) (time.Duration, bool) {
+	if r.HTTPResponse == nil {
+		return 0, false
+	}
+	value := r.HTTPResponse.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if delay := at.Sub(now); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"github.com/ks3sdk/klog-go-sdk/internal/apierr"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestDefaultRetryerShouldRetry(t *testing.T) {
+	retryer := DefaultRetryer{}
+	cases := []struct {
+		err    error
+		status int
+		retry  bool
+	}{
+		// 发送失败时没有响应
+		{apierr.New("RequestError", "send request failed", nil), 0, true},
+		{apierr.New(CanceledErrorCode, "request context canceled", nil), 0, false},
+		{apierr.New("InternalServerError", "", nil), http.StatusInternalServerError, true},
+		{apierr.New("UnknownError", "", nil), http.StatusBadGateway, true},
+		{apierr.New("UnknownError", "", nil), http.StatusTooManyRequests, true},
+		{apierr.New("PostBodyInvalid", "", nil), http.StatusBadRequest, false},
+	}
+	for _, c := range cases {
+		r := &Request{Error: c.err}
+		if c.status != 0 {
+			r.HTTPResponse = &http.Response{StatusCode: c.status, Header: http.Header{}}
+		}
+		assert.Equal(t, c.retry, retryer.ShouldRetry(r), c.err.Error())
+	}
+}
+
+func TestDefaultRetryerRetryDelay(t *testing.T) {
+	retryer := DefaultRetryer{MinDelay: 10 * time.Millisecond, MaxDelay: time.Second}
+
+	for count := uint(0); count < 40; count++ {
+		delay := retryer.RetryDelay(&Request{RetryCount: count})
+		ceiling := time.Second
+		if count < 7 {
+			ceiling = 10 * time.Millisecond << count
+		}
+		assert.True(t, delay >= 0 && delay <= ceiling, "count=%d delay=%s", count, delay)
+	}
+
+	// 超过int范围的纳秒数在32位平台上不溢出
+	for _, retryer := range []DefaultRetryer{{}, {MinDelay: time.Second, MaxDelay: time.Hour}} {
+		max := retryer.MaxDelay
+		if max == 0 {
+			max = DefaultRetryerMaxDelay
+		}
+		for count := uint(0); count < 40; count++ {
+			delay := retryer.RetryDelay(&Request{RetryCount: count})
+			assert.True(t, delay >= 0 && delay <= max, "count=%d delay=%s", count, delay)
+		}
+	}
+
+	// 使用Retry-After，不超过MaxDelay
+	header := http.Header{}
+	r := &Request{HTTPResponse: &http.Response{StatusCode: http.StatusServiceUnavailable, Header: header}}
+	header.Set("Retry-After", "0")
+	assert.Equal(t, time.Duration(0), retryer.RetryDelay(r))
+	header.Set("Retry-After", "30")
+	assert.Equal(t, time.Second, retryer.RetryDelay(r))
+	header.Set("Retry-After", time.Now().Add(3*time.Second).UTC().Format(http.TimeFormat))
+	delay := DefaultRetryer{MaxDelay: 10 * time.Second}.RetryDelay(r)
+	assert.True(t, delay > time.Second && delay <= 3*time.Second, delay.String())
+}
+
+func TestServiceRetryer(t *testing.T) {
+	service := NewService(&Config{Endpoint: "localhost", MaxRetries: DefaultRetries})
+	assert.Equal(t, uint(DefaultRetryerMaxRetries), service.MaxRetries())
+
+	service = NewService(&Config{Endpoint: "localhost", Retryer: DefaultRetryer{NumMaxRetries: 5}})
+	assert.Equal(t, uint(5), service.MaxRetries())
+}
@@ -1,8 +1,6 @@
 package service
 
 import (
-	"github.com/ks3sdklib/aws-sdk-go/aws/awserr"
-	"math"
 	"net/http"
 	"net/http/httputil"
 	"regexp"
@@ -18,6 +16,8 @@ type Service struct {
 	RetryRules        func(*Request) time.Duration
 	ShouldRetry       func(*Request) bool
 	DefaultMaxRetries uint
+
+	endpoints *endpointSet
 }
 
 var schemeRE = regexp.MustCompile("^([^:]+)://")
@@ -40,60 +40,100 @@ func (service *Service) Initialize() {
 		service.Config.HTTPClient = http.DefaultClient
 	}
 
+	retryer := service.Config.Retryer
+	if retryer == nil {
+		retryer = DefaultRetryer{NumMaxRetries: service.Config.MaxRetries}
+	}
+
 	if service.RetryRules == nil {
-		service.RetryRules = retryRules
+		service.RetryRules = retryer.RetryDelay
 	}
 
 	if service.ShouldRetry == nil {
-		service.ShouldRetry = shouldRetry
+		service.ShouldRetry = retryer.ShouldRetry
 	}
 
-	service.DefaultMaxRetries = 3
-	service.Handlers.Validate.PushBack(ValidateEndpointHandler)
-	service.Handlers.Build.PushBack(UserAgentHandler)
-	service.Handlers.Build.PushBack(RequestIdHandler)
-	service.Handlers.Build.PushBack(CommonHeaderHandler)
+	service.DefaultMaxRetries = DefaultRetryerMaxRetries
+	service.Handlers.Validate.PushBackNamed(NamedHandler{Name: ValidateEndpointHandlerName, Fn: ValidateEndpointHandler})
+	service.Handlers.Build.PushBackNamed(NamedHandler{Name: UserAgentHandlerName, Fn: UserAgentHandler})
+	service.Handlers.Build.PushBackNamed(NamedHandler{Name: RequestIdHandlerName, Fn: RequestIdHandler})
+	service.Handlers.Build.PushBackNamed(NamedHandler{Name: CommonHeaderHandlerName, Fn: CommonHeaderHandler})
 
-	if service.Config.CompressMethod == CompressMethodLz4 {
-		service.Handlers.Build.PushBack(CompressLz4)
+	if service.Config.CompressMethod != CompressMethodNone {
+		service.Handlers.Build.PushBackNamed(NamedHandler{Name: CompressHandlerName, Fn: CompressHandler})
 	}
 
 	if !service.Config.DisableComputeChecksums {
-		service.Handlers.Build.PushBack(ContentMD5)
+		service.Handlers.Build.PushBackNamed(NamedHandler{Name: ContentMD5HandlerName, Fn: ContentMD5})
 	}
 
-	service.Handlers.Sign.PushBack(BuildContentLength)
-	service.Handlers.Send.PushBack(SendHandler)
-	service.Handlers.AfterRetry.PushBack(AfterRetryHandler)
-	service.Handlers.ValidateResponse.PushBack(ValidateResponseHandler)
+	service.Handlers.Sign.PushBackNamed(NamedHandler{Name: BuildContentLengthName, Fn: BuildContentLength})
+	service.Handlers.Send.PushBackNamed(NamedHandler{Name: SendHandlerName, Fn: SendHandler})
+	service.Handlers.AfterRetry.PushBackNamed(NamedHandler{Name: AfterRetryHandlerName, Fn: AfterRetryHandler})
+	service.Handlers.ValidateResponse.PushBackNamed(NamedHandler{Name: ValidateResponseHandlerName, Fn: ValidateResponseHandler})
 	if service.Config.Debug {
 		service.AddDebugHandlers()
 	}
 	service.buildEndpoint()
+	if service.endpoints != nil {
+		service.Handlers.Send.PushFrontNamed(NamedHandler{Name: SelectEndpointHandlerName, Fn: SelectEndpointHandler})
+		service.Handlers.Send.PushBackNamed(NamedHandler{Name: EndpointHealthHandlerName, Fn: EndpointHealthHandler})
+	}
+	service.Handlers.Send.PushFrontNamed(NamedHandler{Name: RateLimitHandlerName, Fn: RateLimitHandler})
+	if service.Config.CircuitBreaker != nil {
+		service.Config.CircuitBreaker.AddToHandlers(&service.Handlers)
+	}
 }
 
 // buildEndpoint builds the endpoint values the service will use to make requests with.
+// When fallback endpoints are configured, Endpoint is the most preferred one.
 func (service *Service) buildEndpoint() {
-	service.Endpoint = service.Config.Endpoint
-	if service.Endpoint != "" && !schemeRE.MatchString(service.Endpoint) {
+	var endpoints []string
+	seen := map[string]bool{}
+	for _, e := range append([]string{service.Config.Endpoint}, service.Config.Endpoints...) {
+		e = service.withScheme(e)
+		if e != "" && !seen[e] {
+			seen[e] = true
+			endpoints = append(endpoints, e)
+		}
+	}
+
+	service.Endpoint = ""
+	if len(endpoints) > 0 {
+		service.Endpoint = endpoints[0]
+	}
+	health := service.Config.EndpointHealth
+	if health == nil && len(endpoints) > 1 {
+		health = NewEndpointHealth(EndpointHealthOptions{
+			FailureThreshold: service.Config.EndpointFailureThreshold,
+			EjectDuration:    service.Config.EndpointEjectDuration,
+		})
+	}
+	service.endpoints = newEndpointSet(endpoints, health)
+}
+
+// withScheme adds the scheme to endpoint if it has none.
+func (service *Service) withScheme(endpoint string) string {
+	if endpoint != "" && !schemeRE.MatchString(endpoint) {
 		scheme := "https"
 		if service.Config.DisableSSL {
 			scheme = "http"
 		}
-		service.Endpoint = scheme + "://" + service.Endpoint
+		endpoint = scheme + "://" + endpoint
 	}
+	return endpoint
 }
 
 // AddDebugHandlers injects debug logging handlers into the service to log request
 // debug information.
 func (service *Service) AddDebugHandlers() {
-	service.Handlers.Send.PushFront(func(r *Request) {
+	service.Handlers.Send.PushFrontNamed(NamedHandler{Name: DebugRequestHandlerName, Fn: func(r *Request) {
 		dumpedBody, _ := httputil.DumpRequestOut(r.HTTPRequest, false)
 
 		r.Config.Logger.Infof("---[ REQUEST POST-SIGN ]-----------------------------\nREQUEST BODY SIZE %d\n%s\n-----------------------------------------------------\n",
 			len(string(dumpedBody)), string(dumpedBody))
-	})
-	service.Handlers.Send.PushBack(func(r *Request) {
+	}})
+	service.Handlers.Send.PushBackNamed(NamedHandler{Name: DebugResponseHandlerName, Fn: func(r *Request) {
 		if r.HTTPResponse != nil {
 			dumpedBody, _ := httputil.DumpResponse(r.HTTPResponse, false)
 
@@ -104,43 +144,32 @@ func (service *Service) AddDebugHandlers() {
 			r.Config.Logger.Infof("---[ RESPONSE ]--------------------------------------\n%s\n-----------------------------------------------------\n",
 				r.Error.Error())
 		}
-	})
+	}})
 }
 
 // MaxRetries returns the number of maximum returns the service will use to make
 // an individual API request.
 func (service *Service) MaxRetries() uint {
+	if service.Config.Retryer != nil {
+		if n := service.Config.Retryer.MaxRetries(); n > 0 {
+			return uint(n)
+		}
+		return 0
+	}
 	if service.Config.MaxRetries < 0 {
 		return service.DefaultMaxRetries
 	}
 	return uint(service.Config.MaxRetries)
 }
 
-// retryRules returns the delay duration before retrying this request again
-func retryRules(r *Request) time.Duration {
-	delay := time.Duration(math.Pow(2, float64(r.RetryCount))) * 30
-	return delay * time.Millisecond
-}
-
-// shouldRetry returns if the request should be retried.
-func shouldRetry(r *Request) bool {
-	if r.HTTPResponse.StatusCode >= 500 {
-		return true
-	}
-	if r.Error != nil {
-		if err, ok := r.Error.(awserr.Error); ok {
-			return isCodeRetryable(err.Code())
-		}
-	}
-	return false
-}
-
 // retryableCodes is a collection of service response codes which are retry-able
 // without any further action.
 var retryableCodes = map[string]struct{}{
-	"RequestError":                           {},
-	"ProvisionedThroughputExceededException": {},
-	"Throttling":                             {},
+	"RequestError":        {},
+	"InternalServerError": {},
+	"ServiceUnavailable":  {},
+	"Throttling":          {},
+	"TooManyRequests":     {},
 }
 
 func isCodeExpiredCreds(code string) bool {
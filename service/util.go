@@ -29,6 +29,12 @@ func RandomString() string {
 }
 
 func MakeRandomTimer(count int) *time.Timer {
+	return time.NewTimer(MakeRandomDelay(count))
+}
+
+// MakeRandomDelay returns a random delay of 2^n seconds, where n is in [0, count),
+// capped at 120 seconds.
+func MakeRandomDelay(count int) time.Duration {
 	var sleepSec float64
 	if count < 32 {
 		sleepSec = math.Pow(2, float64(MakeRandomInt(count)))
@@ -38,8 +44,7 @@ func MakeRandomTimer(count int) *time.Timer {
 	} else {
 		sleepSec = 120
 	}
-	timer := time.NewTimer(time.Duration(sleepSec) * time.Second)
-	return timer
+	return time.Duration(sleepSec) * time.Second
 }
 
 func MakeRandomInt(max int) int {
@@ -50,6 +55,20 @@ func MakeRandomInt(max int) int {
 	}
 }
 
+// MakeRandomInt64 returns a random number in [0, max). Unlike MakeRandomInt it
+// does not overflow on 32-bit platforms for max beyond the int range, such as
+// delays in nanoseconds.
+func MakeRandomInt64(max int64) int64 {
+	if max <= 0 {
+		return 0
+	}
+	if i, err := rand.Int(rand.Reader, big.NewInt(max)); err != nil {
+		return 1
+	} else {
+		return i.Int64()
+	}
+}
+
 type generator struct {
 	number uint64
 }